@@ -0,0 +1,83 @@
+// Copyright (C) 2020  Matthew "strager" Glazar
+// See end of file for extended copyright information.
+
+package main
+
+import "io"
+import "strings"
+import "sync"
+
+// ArchiveHandler recurses into one container format's entries (a tar.gz, a
+// zip, a .deb, ...), transforming whichever entries filesToTransform
+// mentions and reassembling the archive around the result.
+type ArchiveHandler func(deepPath DeepPath, archive io.Reader) (FileTransformResult, error)
+
+type registeredArchiveFormat struct {
+	suffixes []string
+	handler  ArchiveHandler
+}
+
+var archiveFormatsMu sync.Mutex
+var archiveFormats []registeredArchiveFormat
+
+// RegisterArchiveFormat adds a container format TransformFile should
+// recurse into, matched by file name suffix (e.g. ".tar.gz", ".zip").
+// Formats register themselves this way (see this file's init) instead of
+// TransformFile growing another PathLooksLike* branch per format, so new
+// container formats (7z, xar for .pkg, ar for .deb) don't require editing
+// its dispatch.
+func RegisterArchiveFormat(suffixes []string, handler ArchiveHandler) {
+	archiveFormatsMu.Lock()
+	defer archiveFormatsMu.Unlock()
+	archiveFormats = append(archiveFormats, registeredArchiveFormat{
+		suffixes: suffixes,
+		handler:  handler,
+	})
+}
+
+// archiveHandlerForPath returns the registered ArchiveHandler whose suffix
+// matches path, or false if path doesn't look like any registered archive
+// format.
+func archiveHandlerForPath(path string) (ArchiveHandler, bool) {
+	archiveFormatsMu.Lock()
+	defer archiveFormatsMu.Unlock()
+	for _, format := range archiveFormats {
+		for _, suffix := range format.suffixes {
+			if strings.HasSuffix(path, suffix) {
+				return format.handler, true
+			}
+		}
+	}
+	return nil, false
+}
+
+func init() {
+	RegisterArchiveFormat([]string{".tar.gz", ".tgz"}, TransformTarGz)
+	RegisterArchiveFormat([]string{".zip", ".nupkg", ".vsix"}, func(deepPath DeepPath, archive io.Reader) (FileTransformResult, error) {
+		content, err := io.ReadAll(archive)
+		if err != nil {
+			return FileTransformResult{}, err
+		}
+		return TransformZip(deepPath, content)
+	})
+	RegisterArchiveFormat([]string{".deb"}, TransformDeb)
+	RegisterArchiveFormat([]string{".rpm"}, TransformRpm)
+}
+
+// quick-lint-js finds bugs in JavaScript programs.
+// Copyright (C) 2020  Matthew "strager" Glazar
+//
+// This file is part of quick-lint-js.
+//
+// quick-lint-js is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// quick-lint-js is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with quick-lint-js.  If not, see <https://www.gnu.org/licenses/>.
@@ -0,0 +1,62 @@
+// Copyright (C) 2020  Matthew "strager" Glazar
+// See end of file for extended copyright information.
+
+package main
+
+import "io"
+import "os"
+
+// writeFileAtomic calls write with a file opened at path+".new", fsyncs and
+// closes it, then renames it over path. If write or the fsync fails, the
+// ".new" file is removed and path is left untouched. This means an
+// interrupted run (a crash, a killed process) never leaves a half-written
+// release artifact for a later step to sign or hash; it only ever leaves a
+// stray ".new" file, which -resume treats as a sign that path's own content
+// can't be trusted (see canResumeSkip).
+func writeFileAtomic(path string, perm os.FileMode, write func(io.Writer) error) error {
+	tempPath := path + ".new"
+	file, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	succeeded := false
+	defer func() {
+		if !succeeded {
+			file.Close()
+			os.Remove(tempPath)
+		}
+	}()
+
+	if err := write(file); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		return err
+	}
+	succeeded = true
+	return nil
+}
+
+// quick-lint-js finds bugs in JavaScript programs.
+// Copyright (C) 2020  Matthew "strager" Glazar
+//
+// This file is part of quick-lint-js.
+//
+// quick-lint-js is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// quick-lint-js is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with quick-lint-js.  If not, see <https://www.gnu.org/licenses/>.
@@ -0,0 +1,629 @@
+// Copyright (C) 2020  Matthew "strager" Glazar
+// See end of file for extended copyright information.
+
+// Package authenticode signs Windows PE binaries with a detached
+// Authenticode signature, without shelling out to osslsigncode. It exists
+// so release signing works on hosts (notably the macOS machine used for
+// AppleCodesign) that don't have osslsigncode installed.
+package authenticode
+
+import "bytes"
+import "crypto"
+import "crypto/ecdsa"
+import "crypto/rand"
+import "crypto/rsa"
+import "crypto/sha256"
+import "crypto/x509"
+import "crypto/x509/pkix"
+import "debug/pe"
+import "encoding/asn1"
+import "encoding/binary"
+import "fmt"
+import "io"
+import "math/big"
+import "net/http"
+import "os"
+import "strings"
+
+import "software.sslmate.com/src/go-pkcs12"
+
+// spcIndirectDataContentOID is the OID Authenticode uses for the content
+// type of the signed data: SPC_INDIRECT_DATA_OBJID.
+var spcIndirectDataContentOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 4}
+
+// Options configures a single Sign call.
+type Options struct {
+	PrivateKeyPKCS12Path string
+	PKCS12Password        string // usually "" for release-signing certs.
+	TimestampURL          string // RFC 3161 timestamp authority; "" disables countersigning.
+}
+
+// Sign reads the unsigned PE at inPath, computes its Authenticode hash,
+// builds a detached PKCS#7 signature, and writes a signed copy to outPath.
+func Sign(inPath string, outPath string, options Options) error {
+	unsignedContent, err := os.ReadFile(inPath)
+	if err != nil {
+		return err
+	}
+
+	peFile, err := pe.Open(inPath)
+	if err != nil {
+		return err
+	}
+	defer peFile.Close()
+
+	layout, err := peAuthenticodeLayout(unsignedContent, peFile)
+	if err != nil {
+		return err
+	}
+	if layout.certTableSize != 0 {
+		return fmt.Errorf("%s is already signed", inPath)
+	}
+
+	digest, err := authenticodeHash(unsignedContent, layout.checksumOffset, int64(layout.certTableDirOffset))
+	if err != nil {
+		return err
+	}
+
+	pkcs12Data, err := os.ReadFile(options.PrivateKeyPKCS12Path)
+	if err != nil {
+		return err
+	}
+	rawPrivateKey, certificate, err := pkcs12.Decode(pkcs12Data, options.PKCS12Password)
+	if err != nil {
+		return err
+	}
+	privateKey, ok := rawPrivateKey.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("%s does not contain a signing key", options.PrivateKeyPKCS12Path)
+	}
+
+	signedData, err := signSpcIndirectData(digest, privateKey, certificate)
+	if err != nil {
+		return err
+	}
+
+	if options.TimestampURL != "" {
+		if err := countersignRFC3161(signedData, options.TimestampURL); err != nil {
+			return err
+		}
+	}
+
+	der, err := signedData.marshal()
+	if err != nil {
+		return err
+	}
+
+	signedContent, err := spliceWinCertificate(unsignedContent, der, layout)
+	if err != nil {
+		return err
+	}
+
+	// Write to a ".new" sibling and rename it over outPath, so a process
+	// killed mid-write never leaves a half-signed outPath for a later step
+	// (hashing, GPG-signing, -Verify) to trust.
+	tempOutPath := outPath + ".new"
+	if err := os.WriteFile(tempOutPath, signedContent, 0755); err != nil {
+		os.Remove(tempOutPath)
+		return err
+	}
+	return os.Rename(tempOutPath, outPath)
+}
+
+// peLayout describes the handful of PE file offsets Authenticode cares
+// about. All offsets are raw file offsets, not RVAs (the Certificate Table
+// data directory is documented as a special case: its VirtualAddress field
+// is actually a file offset, since the certificate table isn't mapped into
+// memory at load time).
+type peLayout struct {
+	checksumOffset     int64  // IMAGE_OPTIONAL_HEADER.CheckSum
+	certTableDirOffset uint32 // the 8-byte IMAGE_DIRECTORY_ENTRY_SECURITY entry itself
+	certTableOffset    uint32 // dir.VirtualAddress: where the certificate table starts (0 if absent)
+	certTableSize      uint32 // dir.Size (0 if absent)
+}
+
+// peAuthenticodeLayout locates the offsets peLayout describes. debug/pe
+// doesn't expose raw header file offsets, so we locate the PE header
+// ourselves via the DOS stub's e_lfanew field, same as osslsigncode does.
+func peAuthenticodeLayout(content []byte, file *pe.File) (peLayout, error) {
+	if len(content) < 0x40 {
+		return peLayout{}, fmt.Errorf("file too small to be a PE image")
+	}
+	peHeaderOffset := int64(binary.LittleEndian.Uint32(content[0x3c:0x40]))
+	const coffHeaderSize = 20
+	const checksumFieldOffsetInOptionalHeader = 64
+	checksumOffset := peHeaderOffset + 4 /* "PE\0\0" */ + coffHeaderSize + checksumFieldOffsetInOptionalHeader
+	optionalHeaderOffset := peHeaderOffset + 4 + coffHeaderSize
+
+	const securityDirectoryIndex = 4 // IMAGE_DIRECTORY_ENTRY_SECURITY
+	switch optionalHeader := file.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		const dataDirectoryArrayOffset = 96 // sizeof(IMAGE_OPTIONAL_HEADER32) up to DataDirectory
+		dir := optionalHeader.DataDirectory[securityDirectoryIndex]
+		return peLayout{
+			checksumOffset:     checksumOffset,
+			certTableDirOffset: uint32(optionalHeaderOffset) + dataDirectoryArrayOffset + securityDirectoryIndex*8,
+			certTableOffset:    dir.VirtualAddress,
+			certTableSize:      dir.Size,
+		}, nil
+	case *pe.OptionalHeader64:
+		const dataDirectoryArrayOffset = 112 // sizeof(IMAGE_OPTIONAL_HEADER64) up to DataDirectory
+		dir := optionalHeader.DataDirectory[securityDirectoryIndex]
+		return peLayout{
+			checksumOffset:     checksumOffset,
+			certTableDirOffset: uint32(optionalHeaderOffset) + dataDirectoryArrayOffset + securityDirectoryIndex*8,
+			certTableOffset:    dir.VirtualAddress,
+			certTableSize:      dir.Size,
+		}, nil
+	default:
+		return peLayout{}, fmt.Errorf("unrecognized PE optional header")
+	}
+}
+
+// authenticodeHash hashes content with SHA-256, skipping the 4-byte
+// checksum field and the 8-byte certificate table data directory entry
+// (RVA/offset + size), per the Authenticode spec section "Calculating the
+// PE Image Hash". Since content is unsigned, there is no certificate table
+// to additionally exclude.
+func authenticodeHash(content []byte, checksumOffset int64, certTableDirOffset int64) ([]byte, error) {
+	hasher := sha256.New()
+
+	writeRange := func(start, end int64) error {
+		if start >= end {
+			return nil
+		}
+		_, err := hasher.Write(content[start:end])
+		return err
+	}
+
+	if err := writeRange(0, checksumOffset); err != nil {
+		return nil, err
+	}
+	if err := writeRange(checksumOffset+4, certTableDirOffset); err != nil {
+		return nil, err
+	}
+	if err := writeRange(certTableDirOffset+8, int64(len(content))); err != nil {
+		return nil, err
+	}
+
+	return hasher.Sum(nil), nil
+}
+
+// signSpcIndirectData wraps digest in a SpcIndirectDataContent structure and
+// signs it as a PKCS#7 SignedData, as Authenticode requires (a bare
+// "signed hash" PKCS#7 is not sufficient; Windows expects the
+// SPC_INDIRECT_DATA_OBJID content type). Built by hand rather than with
+// go.mozilla.org/pkcs7's SignedData: that library hardcodes the inner
+// content type to id-data and has no way to override it, so it can't
+// produce a SpcIndirectDataContent-typed SignedData. See pkcs7.go.
+func signSpcIndirectData(digest []byte, privateKey crypto.Signer, certificate *x509.Certificate) (*authenticodeSignedData, error) {
+	spcIndirectData, err := asn1.Marshal(struct {
+		Data struct {
+			Type  asn1.ObjectIdentifier
+			Value asn1.RawValue `asn1:"optional"`
+		}
+		MessageDigest struct {
+			DigestAlgorithm pkix.AlgorithmIdentifier
+			Digest          []byte
+		}
+	}{
+		Data: struct {
+			Type  asn1.ObjectIdentifier
+			Value asn1.RawValue `asn1:"optional"`
+		}{Type: spcIndirectDataContentOID},
+		MessageDigest: struct {
+			DigestAlgorithm pkix.AlgorithmIdentifier
+			Digest          []byte
+		}{DigestAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256}, Digest: digest},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return newSignedData(spcIndirectDataContentOID, spcIndirectData, privateKey, certificate)
+}
+
+// rfc3161MessageImprint is RFC 3161's MessageImprint: the hash of the data
+// being timestamped.
+type rfc3161MessageImprint struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+// rfc3161TimeStampReq is RFC 3161's TimeStampReq. CertReq asks the TSA to
+// include its own certificate in the response, so the resulting
+// TimeStampToken is self-contained and can be embedded as-is in the
+// Authenticode unauthenticated attribute.
+type rfc3161TimeStampReq struct {
+	Version        int
+	MessageImprint rfc3161MessageImprint
+	ReqPolicy      asn1.ObjectIdentifier `asn1:"optional"`
+	Nonce          *big.Int              `asn1:"optional"`
+	CertReq        bool                  `asn1:"optional"`
+}
+
+// rfc3161PKIStatusInfo is RFC 3161's PKIStatusInfo. Status 0 (granted) and
+// 1 (grantedWithMods) both mean the TSA issued a token.
+type rfc3161PKIStatusInfo struct {
+	Status       int
+	StatusString []string       `asn1:"optional"`
+	FailInfo     asn1.BitString `asn1:"optional"`
+}
+
+// rfc3161TimeStampResp is RFC 3161's TimeStampResp. TimeStampToken is a
+// PKCS#7 ContentInfo; it's left as raw DER since all we do with it is embed
+// it verbatim as the Authenticode countersignature, after
+// verifyTimeStampToken has checked it actually answers our request.
+type rfc3161TimeStampResp struct {
+	Status         rfc3161PKIStatusInfo
+	TimeStampToken asn1.RawValue `asn1:"optional"`
+}
+
+// rfc3161TSTInfo is RFC 3161's TSTInfo, the content the TSA signs inside
+// TimeStampToken. verifyTimeStampToken only checks MessageImprint and Nonce;
+// GenTime is kept as raw bytes since we don't interpret it, and the fields
+// after Nonce (tsa, extensions) are not decoded at all.
+type rfc3161TSTInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint rfc3161MessageImprint
+	SerialNumber   *big.Int
+	GenTime        asn1.RawValue
+	Accuracy       rfc3161Accuracy `asn1:"optional"`
+	Ordering       bool            `asn1:"optional"`
+	Nonce          *big.Int        `asn1:"optional"`
+}
+
+// rfc3161Accuracy is RFC 3161's Accuracy. It is a typed SEQUENCE rather than
+// an asn1.RawValue so that, when a TSA omits it, the Nonce INTEGER that
+// follows isn't decoded as Accuracy instead.
+type rfc3161Accuracy struct {
+	Seconds int `asn1:"optional"`
+	Millis  int `asn1:"optional,tag:0"`
+	Micros  int `asn1:"optional,tag:1"`
+}
+
+// asn1OuterContentInfo and asn1TSTSignedData peel back TimeStampToken's
+// PKCS#7 ContentInfo/SignedData wrapping; they're not the full
+// authenticodeSignedData/signerInfoASN1 types (see pkcs7.go for those)
+// because those are shaped for building a SignedData we sign, not for
+// reading an arbitrary one back, but Certificates is kept (as raw DER) and
+// SignerInfos reuses signerInfoASN1 directly since verifyTimeStampToken needs
+// to check the TSA's signature and certificate, not just reach the
+// encapsulated TSTInfo.
+type asn1OuterContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+type asn1EncapContentInfo struct {
+	EContentType asn1.ObjectIdentifier
+	EContent     []byte `asn1:"explicit,tag:0,optional"`
+}
+
+type asn1TSTSignedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue `asn1:"set"`
+	EncapContentInfo asn1EncapContentInfo
+	Certificates     asn1.RawValue    `asn1:"optional,tag:0"`
+	SignerInfos      []signerInfoASN1 `asn1:"set"`
+}
+
+// verifyTimeStampToken extracts the TSTInfo a TSA signed inside
+// timeStampToken and checks that it actually answers our request: that its
+// messageImprint matches what we asked to be timestamped, and that its
+// nonce matches the one we sent. It also verifies that the token's own
+// PKCS#7 signature is valid and that the signing certificate chains to a
+// trusted root with the timeStamping EKU. Without all of this, a TSA (or a
+// MITM, if timestampURL isn't pinned) could return any previously-issued,
+// unrelated, or outright forged TimeStampToken and countersignRFC3161 would
+// embed it as if it covered this signature.
+func verifyTimeStampToken(timeStampToken []byte, wantMessageImprint []byte, wantNonce *big.Int) error {
+	var outer asn1OuterContentInfo
+	if _, err := asn1.Unmarshal(timeStampToken, &outer); err != nil {
+		return fmt.Errorf("parsing TimeStampToken ContentInfo: %w", err)
+	}
+	if !outer.ContentType.Equal(oidSignedData) {
+		return fmt.Errorf("TimeStampToken is not a PKCS#7 SignedData: %v", outer.ContentType)
+	}
+
+	var signedData asn1TSTSignedData
+	if _, err := asn1.Unmarshal(outer.Content.Bytes, &signedData); err != nil {
+		return fmt.Errorf("parsing TimeStampToken SignedData: %w", err)
+	}
+
+	var tstInfo rfc3161TSTInfo
+	if _, err := asn1.Unmarshal(signedData.EncapContentInfo.EContent, &tstInfo); err != nil {
+		return fmt.Errorf("parsing TSTInfo: %w", err)
+	}
+
+	if !bytes.Equal(tstInfo.MessageImprint.HashedMessage, wantMessageImprint) {
+		return fmt.Errorf("TSTInfo messageImprint does not match the requested hash")
+	}
+	if wantNonce != nil && (tstInfo.Nonce == nil || tstInfo.Nonce.Cmp(wantNonce) != 0) {
+		return fmt.Errorf("TSTInfo nonce does not match the request's nonce")
+	}
+
+	if len(signedData.SignerInfos) == 0 {
+		return fmt.Errorf("TimeStampToken SignedData carries no SignerInfos")
+	}
+	certificates, err := x509.ParseCertificates(signedData.Certificates.Bytes)
+	if err != nil {
+		return fmt.Errorf("parsing TimeStampToken certificates: %w", err)
+	}
+	for _, signerInfo := range signedData.SignerInfos {
+		if err := verifyTimeStampSignerInfo(signerInfo, certificates, signedData.EncapContentInfo.EContent); err != nil {
+			return fmt.Errorf("TimeStampToken signature: %w", err)
+		}
+	}
+	return nil
+}
+
+// verifyTimeStampSignerInfo checks that signerInfo's EncryptedDigest is a
+// valid signature, by the certificate it names among certificates, over
+// econtent (via the signed messageDigest attribute, as PKCS#7 requires),
+// and that that certificate chains to a trusted root with the timeStamping
+// EKU. Without this, anyone able to intercept or replay the HTTP response
+// could hand countersignRFC3161 an unsigned or self-signed TSTInfo that
+// happens to match our messageImprint and nonce.
+func verifyTimeStampSignerInfo(signerInfo signerInfoASN1, certificates []*x509.Certificate, econtent []byte) error {
+	// digestAuthenticatedAttributes and the messageDigest comparison below
+	// both assume SHA-256, matching the sha256.Sum256 hash we put in our own
+	// MessageImprint; a TSA signing with a different algorithm (PKCS#7/RFC
+	// 3161 allow it) would otherwise fail here with a confusing
+	// "does not match"/"signature does not verify" error instead of this
+	// clear one.
+	if !signerInfo.DigestAlgorithm.Algorithm.Equal(oidSHA256) {
+		return fmt.Errorf("unsupported SignerInfo digest algorithm: %v", signerInfo.DigestAlgorithm.Algorithm)
+	}
+
+	signerCert := findCertificateByIssuerAndSerial(certificates, signerInfo.IssuerAndSerialNumber)
+	if signerCert == nil {
+		return fmt.Errorf("signer certificate not found among the TimeStampToken's own Certificates")
+	}
+
+	attrs, err := parseImplicitAttributeSet(signerInfo.AuthenticatedAttributes)
+	if err != nil {
+		return fmt.Errorf("parsing signed attributes: %w", err)
+	}
+	messageDigestValue, ok := findAttribute(attrs, oidMessageDigest)
+	if !ok {
+		return fmt.Errorf("signed attributes carry no messageDigest")
+	}
+	var gotDigest []byte
+	if _, err := asn1.Unmarshal(messageDigestValue.Bytes, &gotDigest); err != nil {
+		return fmt.Errorf("parsing messageDigest attribute: %w", err)
+	}
+	wantDigest := sha256.Sum256(econtent)
+	if !bytes.Equal(gotDigest, wantDigest[:]) {
+		return fmt.Errorf("messageDigest attribute does not match the signed TSTInfo")
+	}
+
+	digest, err := digestAuthenticatedAttributes(attrs)
+	if err != nil {
+		return err
+	}
+	if err := verifyPKCS7Signature(signerCert, digest, signerInfo.EncryptedDigest); err != nil {
+		return err
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certificates {
+		if cert != signerCert {
+			intermediates.AddCert(cert)
+		}
+	}
+	// Unlike signingStuff.GPGKey/AppleCodesignCertificate, timestampURL is
+	// caller-chosen (any RFC 3161 TSA), so there's no single cert to pin the
+	// way trustbundle pins those; VerifyOptions{} falls back to the host's
+	// normal CA pool, the same trust a browser would give the TSA's HTTPS
+	// endpoint.
+	if _, err := signerCert.Verify(x509.VerifyOptions{
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping},
+	}); err != nil {
+		return fmt.Errorf("certificate does not chain to a trusted root with the timeStamping EKU: %w", err)
+	}
+	return nil
+}
+
+// findCertificateByIssuerAndSerial returns the certificate among
+// certificates that issuerAndSerial names, per PKCS#7's convention of
+// identifying a SignerInfo's certificate by issuer name and serial number
+// rather than embedding it directly.
+func findCertificateByIssuerAndSerial(certificates []*x509.Certificate, issuerAndSerial issuerAndSerialNumber) *x509.Certificate {
+	for _, cert := range certificates {
+		if bytes.Equal(cert.RawIssuer, issuerAndSerial.Issuer.FullBytes) &&
+			cert.SerialNumber.Cmp(issuerAndSerial.SerialNumber) == 0 {
+			return cert
+		}
+	}
+	return nil
+}
+
+// parseImplicitAttributeSet decodes raw.Bytes (the concatenated
+// DER-encoded Attributes that attributesAsImplicit built, now read back
+// off the wire) into individual attributes.
+func parseImplicitAttributeSet(raw asn1.RawValue) ([]attribute, error) {
+	var attrs []attribute
+	rest := raw.Bytes
+	for len(rest) > 0 {
+		var attr attribute
+		var err error
+		rest, err = asn1.Unmarshal(rest, &attr)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, attr)
+	}
+	return attrs, nil
+}
+
+// findAttribute returns the AttributeValue of attrs' first entry matching
+// oid, still DER-encoded (as marshalAttribute left it), for the caller to
+// asn1.Unmarshal into the type it expects.
+func findAttribute(attrs []attribute, oid asn1.ObjectIdentifier) (asn1.RawValue, bool) {
+	for _, attr := range attrs {
+		if attr.Type.Equal(oid) {
+			return attr.Value, true
+		}
+	}
+	return asn1.RawValue{}, false
+}
+
+// verifyPKCS7Signature checks signature against digest using certificate's
+// public key, dispatching on key type the same way digestEncryptionAlgorithmFor
+// dispatches on it when producing a signature.
+func verifyPKCS7Signature(certificate *x509.Certificate, digest []byte, signature []byte) error {
+	switch publicKey := certificate.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest, signature)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(publicKey, digest, signature) {
+			return fmt.Errorf("ECDSA signature verification failed")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported signer public key type: %T", certificate.PublicKey)
+	}
+}
+
+// countersignRFC3161 fetches an RFC 3161 timestamp over the just-computed
+// signature and attaches it to signedData as an unauthenticated attribute,
+// so the Authenticode signature remains valid after the signing
+// certificate expires.
+func countersignRFC3161(signedData *authenticodeSignedData, timestampURL string) error {
+	nonce, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return err
+	}
+
+	// Authenticode countersigns the SignerInfo's encryptedDigest (the
+	// signature itself), not the file's own digest.
+	messageImprint := sha256.Sum256(signedData.encryptedDigest)
+	requestDER, err := asn1.Marshal(rfc3161TimeStampReq{
+		Version: 1,
+		MessageImprint: rfc3161MessageImprint{
+			HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256},
+			HashedMessage: messageImprint[:],
+		},
+		Nonce:   nonce,
+		CertReq: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest("POST", timestampURL, bytes.NewReader(requestDER))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/timestamp-query")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	responseDER, err := io.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: HTTP %d", timestampURL, response.StatusCode)
+	}
+
+	var timeStampResp rfc3161TimeStampResp
+	if _, err := asn1.Unmarshal(responseDER, &timeStampResp); err != nil {
+		return fmt.Errorf("%s: parsing RFC 3161 TimeStampResp: %w", timestampURL, err)
+	}
+	// PKIStatus: 0 = granted, 1 = grantedWithMods. Anything else means no
+	// timeStampToken was issued.
+	if timeStampResp.Status.Status != 0 && timeStampResp.Status.Status != 1 {
+		return fmt.Errorf(
+			"%s rejected the timestamp request: status %d: %s",
+			timestampURL,
+			timeStampResp.Status.Status,
+			strings.Join(timeStampResp.Status.StatusString, "; "),
+		)
+	}
+	if len(timeStampResp.TimeStampToken.FullBytes) == 0 {
+		return fmt.Errorf("%s: TimeStampResp carried no timeStampToken", timestampURL)
+	}
+	if err := verifyTimeStampToken(timeStampResp.TimeStampToken.FullBytes, messageImprint[:], nonce); err != nil {
+		return fmt.Errorf("%s: %w", timestampURL, err)
+	}
+
+	return signedData.addUnauthenticatedAttribute(
+		asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 14},
+		asn1.RawValue{FullBytes: timeStampResp.TimeStampToken.FullBytes},
+	)
+}
+
+// spliceWinCertificate writes unsignedContent with a WIN_CERT entry
+// (type WIN_CERT_TYPE_PKCS_SIGNED_DATA, revision 0x0200) appended, 8-byte
+// aligned, and the Certificate Table data directory + PE checksum updated
+// to point at it.
+func spliceWinCertificate(unsignedContent []byte, signatureDER []byte, layout peLayout) ([]byte, error) {
+	const winCertHeaderSize = 8
+	const winCertRevision = 0x0200
+	const winCertTypePKCSSignedData = 0x0002
+
+	certTableOffset := len(unsignedContent)
+	for certTableOffset%8 != 0 {
+		certTableOffset++
+	}
+
+	winCertLength := winCertHeaderSize + len(signatureDER)
+	paddedLength := winCertLength
+	for paddedLength%8 != 0 {
+		paddedLength++
+	}
+
+	out := make([]byte, certTableOffset+paddedLength)
+	copy(out, unsignedContent)
+	binary.LittleEndian.PutUint32(out[certTableOffset:], uint32(winCertLength))
+	binary.LittleEndian.PutUint16(out[certTableOffset+4:], winCertRevision)
+	binary.LittleEndian.PutUint16(out[certTableOffset+6:], winCertTypePKCSSignedData)
+	copy(out[certTableOffset+winCertHeaderSize:], signatureDER)
+
+	binary.LittleEndian.PutUint32(out[layout.certTableDirOffset:], uint32(certTableOffset))
+	binary.LittleEndian.PutUint32(out[layout.certTableDirOffset+4:], uint32(paddedLength))
+
+	binary.LittleEndian.PutUint32(out[layout.checksumOffset:], peChecksum(out, layout.checksumOffset))
+	return out, nil
+}
+
+// peChecksum recomputes IMAGE_OPTIONAL_HEADER.CheckSum per the algorithm in
+// the Microsoft PE/COFF spec (sum of 16-bit words, with the checksum field
+// itself treated as zero, plus the file length).
+func peChecksum(content []byte, checksumOffset int64) uint32 {
+	var sum uint32
+	for i := 0; i+1 < len(content); i += 2 {
+		if int64(i) == checksumOffset || int64(i) == checksumOffset+2 {
+			continue
+		}
+		word := uint32(binary.LittleEndian.Uint16(content[i : i+2]))
+		sum += word
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	sum += uint32(len(content))
+	return sum
+}
+
+// quick-lint-js finds bugs in JavaScript programs.
+// Copyright (C) 2020  Matthew "strager" Glazar
+//
+// This file is part of quick-lint-js.
+//
+// quick-lint-js is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// quick-lint-js is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with quick-lint-js.  If not, see <https://www.gnu.org/licenses/>.
@@ -0,0 +1,276 @@
+// Copyright (C) 2020  Matthew "strager" Glazar
+// See end of file for extended copyright information.
+
+package authenticode
+
+import "bytes"
+import "crypto"
+import "crypto/rand"
+import "crypto/sha256"
+import "crypto/x509"
+import "crypto/x509/pkix"
+import "encoding/asn1"
+import "fmt"
+import "math/big"
+import "sort"
+
+// oidSignedData is PKCS#7's id-signedData content type (RFC 2315 section
+// 7), which wraps the SignedData structure authenticodeSignedData builds.
+var oidSignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+
+var (
+	oidContentType     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSHA256          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRSAEncryption   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+)
+
+// attribute is a PKCS#7 Attribute: a type OID plus a SET OF (here, always
+// exactly one) AttributeValue. Value already carries its own SET tag, built
+// by marshalAttribute.
+type attribute struct {
+	Type  asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+type issuerAndSerialNumber struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type signerInfoASN1 struct {
+	Version                   int
+	IssuerAndSerialNumber     issuerAndSerialNumber
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	AuthenticatedAttributes   asn1.RawValue
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+	UnauthenticatedAttributes asn1.RawValue `asn1:"optional"`
+}
+
+type contentInfoASN1 struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+type signedDataASN1 struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      contentInfoASN1
+	Certificates     asn1.RawValue
+	SignerInfos      []signerInfoASN1 `asn1:"set"`
+}
+
+type outerContentInfoASN1 struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+// authenticodeSignedData holds the PKCS#7 SignedData fields
+// go.mozilla.org/pkcs7 doesn't let callers set: a non-id-data encapsulated
+// content type (SPC_INDIRECT_DATA_OBJID) and unauthenticated attributes
+// (the RFC 3161 countersignature). Authenticode requires both, so the
+// PKCS#7 structure is assembled by hand instead of through that library.
+type authenticodeSignedData struct {
+	econtentType              asn1.ObjectIdentifier
+	econtent                  []byte
+	certificate               *x509.Certificate
+	digestAlgorithm           pkix.AlgorithmIdentifier
+	digestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	authenticatedAttributes   []attribute
+	encryptedDigest           []byte
+	unauthenticatedAttributes []attribute
+}
+
+// newSignedData signs econtent (tagged econtentType) the way Authenticode
+// verifies it: via authenticated "content type" and "message digest"
+// attributes, rather than by signing econtent's bytes directly.
+func newSignedData(econtentType asn1.ObjectIdentifier, econtent []byte, privateKey crypto.Signer, certificate *x509.Certificate) (*authenticodeSignedData, error) {
+	digestEncryptionAlgorithm, err := digestEncryptionAlgorithmFor(certificate)
+	if err != nil {
+		return nil, err
+	}
+
+	contentDigest := sha256.Sum256(econtent)
+	contentTypeAttr, err := marshalAttribute(oidContentType, econtentType)
+	if err != nil {
+		return nil, err
+	}
+	messageDigestAttr, err := marshalAttribute(oidMessageDigest, contentDigest[:])
+	if err != nil {
+		return nil, err
+	}
+	authenticatedAttributes := []attribute{contentTypeAttr, messageDigestAttr}
+
+	digest, err := digestAuthenticatedAttributes(authenticatedAttributes)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := privateKey.Sign(rand.Reader, digest, crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	return &authenticodeSignedData{
+		econtentType:              econtentType,
+		econtent:                  econtent,
+		certificate:               certificate,
+		digestAlgorithm:           pkix.AlgorithmIdentifier{Algorithm: oidSHA256},
+		digestEncryptionAlgorithm: digestEncryptionAlgorithm,
+		authenticatedAttributes:   authenticatedAttributes,
+		encryptedDigest:           signature,
+	}, nil
+}
+
+// addUnauthenticatedAttribute appends an unsigned attribute, e.g. the
+// RFC 3161 countersignature token, to signedData.
+func (signedData *authenticodeSignedData) addUnauthenticatedAttribute(oid asn1.ObjectIdentifier, value interface{}) error {
+	attr, err := marshalAttribute(oid, value)
+	if err != nil {
+		return err
+	}
+	signedData.unauthenticatedAttributes = append(signedData.unauthenticatedAttributes, attr)
+	return nil
+}
+
+// marshal DER-encodes signedData as a PKCS#7 ContentInfo of type
+// id-signedData.
+func (signedData *authenticodeSignedData) marshal() ([]byte, error) {
+	authenticatedAttributes, err := attributesAsImplicit(signedData.authenticatedAttributes, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	signerInfo := signerInfoASN1{
+		Version: 1,
+		IssuerAndSerialNumber: issuerAndSerialNumber{
+			Issuer:       asn1.RawValue{FullBytes: signedData.certificate.RawIssuer},
+			SerialNumber: signedData.certificate.SerialNumber,
+		},
+		DigestAlgorithm:           signedData.digestAlgorithm,
+		AuthenticatedAttributes:   authenticatedAttributes,
+		DigestEncryptionAlgorithm: signedData.digestEncryptionAlgorithm,
+		EncryptedDigest:           signedData.encryptedDigest,
+	}
+	if len(signedData.unauthenticatedAttributes) > 0 {
+		unauthenticatedAttributes, err := attributesAsImplicit(signedData.unauthenticatedAttributes, 1)
+		if err != nil {
+			return nil, err
+		}
+		signerInfo.UnauthenticatedAttributes = unauthenticatedAttributes
+	}
+
+	sd := signedDataASN1{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{signedData.digestAlgorithm},
+		ContentInfo: contentInfoASN1{
+			ContentType: signedData.econtentType,
+			Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signedData.econtent},
+		},
+		Certificates: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signedData.certificate.Raw},
+		SignerInfos:  []signerInfoASN1{signerInfo},
+	}
+	encodedSignedData, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(outerContentInfoASN1{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: encodedSignedData},
+	})
+}
+
+// digestEncryptionAlgorithmFor picks the PKCS#7 digestEncryptionAlgorithm
+// OID matching certificate's key type; privateKey.Sign (called by
+// newSignedData) is expected to produce a signature in the corresponding
+// format (PKCS#1 v1.5 for RSA, ASN.1 DER for ECDSA).
+func digestEncryptionAlgorithmFor(certificate *x509.Certificate) (pkix.AlgorithmIdentifier, error) {
+	switch certificate.PublicKeyAlgorithm {
+	case x509.RSA:
+		return pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption}, nil
+	case x509.ECDSA:
+		return pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256}, nil
+	default:
+		return pkix.AlgorithmIdentifier{}, fmt.Errorf("unsupported certificate public key algorithm: %v", certificate.PublicKeyAlgorithm)
+	}
+}
+
+// marshalAttribute DER-encodes value and wraps it as attribute's sole
+// AttributeValue.
+func marshalAttribute(oid asn1.ObjectIdentifier, value interface{}) (attribute, error) {
+	encodedValue, err := asn1.Marshal(value)
+	if err != nil {
+		return attribute{}, err
+	}
+	return attribute{
+		Type:  oid,
+		Value: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: encodedValue},
+	}, nil
+}
+
+// attributesBody DER-encodes each of attrs and concatenates the results in
+// ascending order, as DER's SET OF encoding requires.
+func attributesBody(attrs []attribute) ([]byte, error) {
+	encoded := make([][]byte, len(attrs))
+	for i, attr := range attrs {
+		var err error
+		encoded[i], err = asn1.Marshal(attr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(encoded, func(i, j int) bool { return bytes.Compare(encoded[i], encoded[j]) < 0 })
+
+	var body bytes.Buffer
+	for _, e := range encoded {
+		body.Write(e)
+	}
+	return body.Bytes(), nil
+}
+
+// attributesAsImplicit DER-encodes attrs as an IMPLICIT [tag] SET OF
+// Attribute, the form SignerInfo's authenticatedAttributes and
+// unauthenticatedAttributes fields use.
+func attributesAsImplicit(attrs []attribute, tag int) (asn1.RawValue, error) {
+	body, err := attributesBody(attrs)
+	if err != nil {
+		return asn1.RawValue{}, err
+	}
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: tag, IsCompound: true, Bytes: body}, nil
+}
+
+// digestAuthenticatedAttributes hashes attrs the way Authenticode verifiers
+// do: DER-encoded as an ordinary SET OF Attribute (universal tag 17), not
+// with the IMPLICIT tag they carry inside SignerInfo.
+func digestAuthenticatedAttributes(attrs []attribute) ([]byte, error) {
+	body, err := attributesBody(attrs)
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: body})
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(encoded)
+	return digest[:], nil
+}
+
+// quick-lint-js finds bugs in JavaScript programs.
+// Copyright (C) 2020  Matthew "strager" Glazar
+//
+// This file is part of quick-lint-js.
+//
+// quick-lint-js is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// quick-lint-js is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with quick-lint-js.  If not, see <https://www.gnu.org/licenses/>.
@@ -0,0 +1,233 @@
+// Copyright (C) 2020  Matthew "strager" Glazar
+// See end of file for extended copyright information.
+
+package main
+
+import "fmt"
+import "io"
+import "io/ioutil"
+import "os"
+import "os/exec"
+import "path/filepath"
+
+// CodeSigner applies a platform-specific code signature to a single
+// executable and checks that a previously-applied signature verifies.
+// AutoCodeSignTransform picks an implementation by sniffing the
+// executable's file magic rather than trusting the source path, so a
+// single filesToTransform entry works regardless of which platform the
+// binary targets (useful for paths like npm's "bin/quick-lint-js" that
+// don't otherwise say whether they hold a Mach-O, PE, or ELF binary).
+type CodeSigner interface {
+	// Sign reads the unsigned executable at inPath and writes a signed copy
+	// to outPath. inPath and outPath may refer to the same file.
+	Sign(inPath string, outPath string) error
+	// Verify checks that path carries a valid signature from this signer's
+	// identity/certificate/token.
+	Verify(path string) error
+}
+
+// FileMagic identifies the executable format of a blob of bytes.
+type FileMagic int
+
+const (
+	MagicUnknown FileMagic = iota
+	MagicPE
+	MagicMachO
+	MagicELF
+)
+
+// DetectFileMagic sniffs content's executable format.
+func DetectFileMagic(content []byte) FileMagic {
+	if looksLikePE(content) {
+		return MagicPE
+	}
+	if looksLikeMachO(content) {
+		return MagicMachO
+	}
+	if len(content) >= 4 && content[0] == 0x7f && content[1] == 'E' && content[2] == 'L' && content[3] == 'F' {
+		return MagicELF
+	}
+	return MagicUnknown
+}
+
+// CodeSignerForMagic returns the CodeSigner backend for magic, or false if
+// no backend is registered for it (e.g. MagicUnknown).
+func CodeSignerForMagic(magic FileMagic) (CodeSigner, bool) {
+	switch magic {
+	case MagicMachO:
+		return appleCodeSigner{}, true
+	case MagicPE:
+		return windowsCodeSigner{}, true
+	case MagicELF:
+		return linuxPKCS11CodeSigner{}, true
+	default:
+		return nil, false
+	}
+}
+
+// appleCodeSigner signs Mach-O binaries with the macOS codesign(1) utility.
+// It wraps the existing AppleCodesignFile/AppleCodesignVerifyFile, which
+// predate the CodeSigner interface and sign in place.
+type appleCodeSigner struct{}
+
+func (appleCodeSigner) Sign(inPath string, outPath string) error {
+	if err := copyFileIfDifferentPath(inPath, outPath); err != nil {
+		return err
+	}
+	return AppleCodesignFile(outPath)
+}
+
+func (appleCodeSigner) Verify(path string) error {
+	return AppleCodesignVerifyFile(path)
+}
+
+// windowsCodeSigner signs PE binaries with an Authenticode signature. It
+// wraps the existing MicrosoftOsslsigncodeFile/MicrosoftOsslsigncodeVerifyFile,
+// which already take separate in/out paths.
+type windowsCodeSigner struct{}
+
+func (windowsCodeSigner) Sign(inPath string, outPath string) error {
+	return MicrosoftOsslsigncodeFile(inPath, outPath)
+}
+
+func (windowsCodeSigner) Verify(path string) error {
+	return MicrosoftOsslsigncodeVerifyFile(path)
+}
+
+// linuxPKCS11CodeSigner signs ELF binaries with a PKCS#11-backed key (a
+// hardware token or an HSM), via OpenSSL's pkcs11 engine. Unlike Mach-O and
+// PE, ELF has no standard in-file signature slot, so the signature is
+// written as a "<name>.sig" sibling instead of modifying the binary; see
+// AutoCodeSignTransform.
+type linuxPKCS11CodeSigner struct{}
+
+func (linuxPKCS11CodeSigner) Sign(inPath string, outPath string) error {
+	if err := copyFileIfDifferentPath(inPath, outPath); err != nil {
+		return err
+	}
+	process := exec.Command(
+		"openssl", "dgst", "-sha256",
+		"-engine", "pkcs11", "-keyform", "engine",
+		"-sign", pkcs11KeyURI(),
+		"-out", outPath+".sig",
+		"--", outPath,
+	)
+	process.Stdout = os.Stdout
+	process.Stderr = os.Stderr
+	if err := process.Start(); err != nil {
+		return err
+	}
+	return process.Wait()
+}
+
+func (linuxPKCS11CodeSigner) Verify(path string) error {
+	process := exec.Command(
+		"openssl", "dgst", "-sha256",
+		"-engine", "pkcs11", "-keyform", "engine",
+		"-verify", pkcs11KeyURI(),
+		"-signature", path+".sig",
+		"--", path,
+	)
+	process.Stdout = os.Stdout
+	process.Stderr = os.Stderr
+	if err := process.Start(); err != nil {
+		return err
+	}
+	return process.Wait()
+}
+
+// pkcs11KeyURI builds the "pkcs11:" URI (RFC 7512) that OpenSSL's pkcs11
+// engine uses to locate signingStuff.PKCS11ModulePath/TokenLabel/KeyLabel's
+// key.
+func pkcs11KeyURI() string {
+	return fmt.Sprintf(
+		"pkcs11:module-path=%s;token=%s;object=%s;type=private",
+		signingStuff.PKCS11ModulePath,
+		signingStuff.PKCS11TokenLabel,
+		signingStuff.PKCS11KeyLabel,
+	)
+}
+
+func copyFileIfDifferentPath(inPath string, outPath string) error {
+	if inPath == outPath {
+		return nil
+	}
+	content, err := os.ReadFile(inPath)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(outPath, content, 0755)
+}
+
+// AutoCodeSignTransform signs exe with whichever CodeSigner matches its
+// file magic (Mach-O, PE, or ELF), rather than the explicit AppleCodesign
+// or MicrosoftOsslsigncode transform types, which assume the platform from
+// the source path instead of sniffing the bytes.
+func AutoCodeSignTransform(originalPath string, exe io.Reader) (FileTransformResult, error) {
+	content, err := io.ReadAll(exe)
+	if err != nil {
+		return FileTransformResult{}, err
+	}
+
+	magic := DetectFileMagic(content)
+	signer, ok := CodeSignerForMagic(magic)
+	if !ok {
+		return FileTransformResult{}, fmt.Errorf("%s: unrecognized executable format; cannot pick a code signer", originalPath)
+	}
+
+	tempDir, err := ioutil.TempDir("", "quick-lint-js-sign-release")
+	if err != nil {
+		return FileTransformResult{}, err
+	}
+	addTempDir(tempDir)
+
+	// Name the file the same as the original, for the same reason
+	// AppleCodesignTransform does: codesign sometimes uses the file name as
+	// the Identifier.
+	signedPath := filepath.Join(tempDir, filepath.Base(originalPath))
+	if err := os.WriteFile(signedPath, content, 0755); err != nil {
+		return FileTransformResult{}, err
+	}
+
+	if err := signer.Sign(signedPath, signedPath); err != nil {
+		return FileTransformResult{}, err
+	}
+	if err := signer.Verify(signedPath); err != nil {
+		return FileTransformResult{}, err
+	}
+
+	signedContent, err := os.ReadFile(signedPath)
+	if err != nil {
+		return FileTransformResult{}, err
+	}
+	result := FileTransformResult{newFile: &signedContent}
+
+	if magic == MagicELF {
+		sigContent, err := os.ReadFile(signedPath + ".sig")
+		if err != nil {
+			return FileTransformResult{}, err
+		}
+		result.siblingFile = &sigContent
+		result.siblingFileName = filepath.Base(originalPath) + ".sig"
+	}
+
+	return result, nil
+}
+
+// quick-lint-js finds bugs in JavaScript programs.
+// Copyright (C) 2020  Matthew "strager" Glazar
+//
+// This file is part of quick-lint-js.
+//
+// quick-lint-js is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// quick-lint-js is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with quick-lint-js.  If not, see <https://www.gnu.org/licenses/>.
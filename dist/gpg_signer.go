@@ -0,0 +1,179 @@
+// Copyright (C) 2020  Matthew "strager" Glazar
+// See end of file for extended copyright information.
+
+package main
+
+import "bytes"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "os/exec"
+
+import "github.com/ProtonMail/gopenpgp/v2/crypto"
+
+// GPGSigner produces detached OpenPGP signatures for release artifacts.
+// By default it shells out to gpg(1); set UseInProcess to sign with an
+// in-memory gopenpgp key instead, for CI containers that have no
+// gpg-agent (or no gpg binary at all).
+type GPGSigner struct {
+	Identity     string // Fingerprint, email, or name passed to gpg -u / --local-user.
+	Key          []byte // Armored public (and, for UseInProcess, private) key material.
+	UseInProcess bool
+}
+
+// gpgSigner is configured from signingStuff in main and used for both the
+// per-archive ".asc" siblings and the top-level SHA256SUMS.asc / source
+// tarball signature.
+var gpgSigner *GPGSigner
+
+// SignFileDetached signs path and writes the detached armored signature to
+// path + ".asc", returning its contents.
+func (signer *GPGSigner) SignFileDetached(path string) ([]byte, error) {
+	if signer.UseInProcess {
+		return signer.signFileDetachedInProcess(path)
+	}
+	return signer.signFileDetachedWithGPGBinary(path)
+}
+
+func (signer *GPGSigner) signFileDetachedWithGPGBinary(path string) ([]byte, error) {
+	process := exec.Command(
+		"gpg",
+		"--local-user", signer.Identity,
+		"--armor",
+		"--detach-sign",
+		"--",
+		path,
+	)
+	process.Stdout = os.Stdout
+	process.Stderr = os.Stderr
+	if err := process.Start(); err != nil {
+		return nil, err
+	}
+	if err := process.Wait(); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(path + ".asc")
+}
+
+func (signer *GPGSigner) signFileDetachedInProcess(path string) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey, err := crypto.NewKeyFromArmored(string(signer.Key))
+	if err != nil {
+		return nil, err
+	}
+	signingKeyRing, err := crypto.NewKeyRing(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := signingKeyRing.SignDetached(crypto.NewPlainMessage(content))
+	if err != nil {
+		return nil, err
+	}
+	armoredSignature, err := signature.GetArmored()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ioutil.WriteFile(path+".asc", []byte(armoredSignature), 0644); err != nil {
+		return nil, err
+	}
+	return []byte(armoredSignature), nil
+}
+
+// VerifyDetachedSignature checks that sigPath is a valid detached signature
+// of file by a key matching signer.Key.
+func (signer *GPGSigner) VerifyDetachedSignature(file string, sigPath string) error {
+	if signer.UseInProcess {
+		return signer.verifyDetachedSignatureInProcess(file, sigPath)
+	}
+	return signer.verifyDetachedSignatureWithGPGBinary(file, sigPath)
+}
+
+func (signer *GPGSigner) verifyDetachedSignatureWithGPGBinary(file string, sigPath string) error {
+	// HACK(strager): Use /tmp instead of the default temp dir. macOS'
+	// default temp dir is so long that it breaks gpg-agent.
+	tempGPGHome, err := ioutil.TempDir("/tmp", "quick-lint-js-sign-release")
+	if err != nil {
+		return err
+	}
+	addTempDir(tempGPGHome)
+
+	var env []string
+	env = append([]string{}, os.Environ()...)
+	env = append(env, "GNUPGHOME="+tempGPGHome)
+
+	process := exec.Command("gpg", "--import")
+	process.Stdin = bytes.NewReader(signer.Key)
+	process.Stdout = os.Stdout
+	process.Stderr = os.Stderr
+	process.Env = env
+	if err := process.Start(); err != nil {
+		return err
+	}
+	if err := process.Wait(); err != nil {
+		return err
+	}
+
+	process = exec.Command("gpg", "--verify", "--", sigPath, file)
+	process.Stdout = os.Stdout
+	process.Stderr = os.Stderr
+	process.Env = env
+	if err := process.Start(); err != nil {
+		return err
+	}
+	if err := process.Wait(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (signer *GPGSigner) verifyDetachedSignatureInProcess(file string, sigPath string) error {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	armoredSignature, err := os.ReadFile(sigPath)
+	if err != nil {
+		return err
+	}
+
+	publicKey, err := crypto.NewKeyFromArmored(string(signer.Key))
+	if err != nil {
+		return err
+	}
+	verifyingKeyRing, err := crypto.NewKeyRing(publicKey)
+	if err != nil {
+		return err
+	}
+	signature, err := crypto.NewPGPSignatureFromArmored(string(armoredSignature))
+	if err != nil {
+		return err
+	}
+	if err := verifyingKeyRing.VerifyDetached(crypto.NewPlainMessage(content), signature, crypto.GetUnixTime()); err != nil {
+		return fmt.Errorf("signature verification failed for %s: %w", file, err)
+	}
+	return nil
+}
+
+// quick-lint-js finds bugs in JavaScript programs.
+// Copyright (C) 2020  Matthew "strager" Glazar
+//
+// This file is part of quick-lint-js.
+//
+// quick-lint-js is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// quick-lint-js is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with quick-lint-js.  If not, see <https://www.gnu.org/licenses/>.
@@ -0,0 +1,216 @@
+// Copyright (C) 2020  Matthew "strager" Glazar
+// See end of file for extended copyright information.
+
+package main
+
+import "bytes"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "os"
+import "os/exec"
+import "path/filepath"
+import "strings"
+
+import "github.com/blakesmith/ar"
+
+func PathLooksLikeDeb(path string) bool {
+	return strings.HasSuffix(path, ".deb")
+}
+
+func PathLooksLikeRpm(path string) bool {
+	return strings.HasSuffix(path, ".rpm")
+}
+
+// TransformDeb re-signs a .deb archive. A .deb is itself an ar(1) archive
+// with (in order) a "debian-binary" member, a "control.tar.*" member, and a
+// "data.tar.*" member. Any signable binaries inside control.tar.gz or
+// data.tar.gz (e.g. a quick-lint-js ELF binary) are recursively signed
+// first, then the outer package is re-signed with a detached "_gpgorigin"
+// member, per the debsigs/dpkg-sig convention.
+func TransformDeb(debDeepPath DeepPath, sourceFile io.Reader) (FileTransformResult, error) {
+	sourceContent, err := io.ReadAll(sourceFile)
+	if err != nil {
+		return FileTransformResult{}, err
+	}
+
+	return signArchiveContainer(debDeepPath, sourceContent, DebSign, func(sourceContent []byte) (FileTransformResult, error) {
+		type arMember struct {
+			header  ar.Header
+			content []byte
+		}
+		var members []arMember
+		arReader := ar.NewReader(bytes.NewReader(sourceContent))
+		for {
+			header, err := arReader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return FileTransformResult{}, err
+			}
+			content, err := io.ReadAll(arReader)
+			if err != nil {
+				return FileTransformResult{}, err
+			}
+
+			if strings.HasPrefix(header.Name, "control.tar") || strings.HasPrefix(header.Name, "data.tar") {
+				if PathLooksLikeTarGz(header.Name) {
+					memberDeepPath, err := debDeepPath.Append(header.Name)
+					if err != nil {
+						return FileTransformResult{}, err
+					}
+					var transformed bytes.Buffer
+					if err := TransformTarGzToFile(memberDeepPath, bytes.NewReader(content), &transformed); err != nil {
+						return FileTransformResult{}, err
+					}
+					content = transformed.Bytes()
+					header.Size = int64(len(content))
+				}
+			}
+
+			members = append(members, arMember{header: *header, content: content})
+		}
+
+		var rebuilt bytes.Buffer
+		arWriter := ar.NewWriter(&rebuilt)
+		if err := arWriter.WriteGlobalHeader(); err != nil {
+			return FileTransformResult{}, err
+		}
+		for _, member := range members {
+			if err := arWriter.WriteHeader(&member.header); err != nil {
+				return FileTransformResult{}, err
+			}
+			if _, err := arWriter.Write(member.content); err != nil {
+				return FileTransformResult{}, err
+			}
+		}
+
+		gpgOrigin, err := DebSignOrigin(rebuilt.Bytes())
+		if err != nil {
+			return FileTransformResult{}, err
+		}
+		if err := arWriter.WriteHeader(&ar.Header{
+			Name: "_gpgorigin",
+			Size: int64(len(gpgOrigin)),
+			Mode: 0644,
+		}); err != nil {
+			return FileTransformResult{}, err
+		}
+		if _, err := arWriter.Write(gpgOrigin); err != nil {
+			return FileTransformResult{}, err
+		}
+
+		rebuiltContent := rebuilt.Bytes()
+		return FileTransformResult{newFile: &rebuiltContent}, nil
+	})
+}
+
+// DebSignOrigin GPG-signs debContent (the .deb with members but no
+// "_gpgorigin" yet) and returns the detached ASCII-armored signature that
+// becomes the "_gpgorigin" member, per dpkg-sig's format.
+func DebSignOrigin(debContent []byte) ([]byte, error) {
+	tempDir, err := ioutil.TempDir("", "quick-lint-js-sign-release")
+	if err != nil {
+		return nil, err
+	}
+	addTempDir(tempDir)
+
+	debPath := filepath.Join(tempDir, "package.deb")
+	if err := os.WriteFile(debPath, debContent, 0644); err != nil {
+		return nil, err
+	}
+
+	signaturePath, err := GPGSignFile(debPath)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(signaturePath)
+}
+
+// TransformRpm re-signs an .rpm package. An RPM file is a lead, a signature
+// header, a header, and a (usually cpio-in-gzip) payload; rpmsign rewrites
+// the signature header in place, so unlike TransformDeb and TransformTarGz
+// we don't parse the inner layout ourselves -- we shell out to rpmsign and
+// let it do so.
+func TransformRpm(rpmDeepPath DeepPath, sourceFile io.Reader) (FileTransformResult, error) {
+	sourceContent, err := io.ReadAll(sourceFile)
+	if err != nil {
+		return FileTransformResult{}, err
+	}
+
+	return signArchiveContainer(rpmDeepPath, sourceContent, RpmSign, func(sourceContent []byte) (FileTransformResult, error) {
+		tempDir, err := ioutil.TempDir("", "quick-lint-js-sign-release")
+		if err != nil {
+			return FileTransformResult{}, err
+		}
+		addTempDir(tempDir)
+
+		unsignedPath := filepath.Join(tempDir, filepath.Base(rpmDeepPath.Last()))
+		if err := os.WriteFile(unsignedPath, sourceContent, 0644); err != nil {
+			return FileTransformResult{}, err
+		}
+
+		if err := RpmSignFile(unsignedPath, tempDir); err != nil {
+			return FileTransformResult{}, err
+		}
+
+		signedContent, err := os.ReadFile(unsignedPath)
+		if err != nil {
+			return FileTransformResult{}, err
+		}
+		return FileTransformResult{newFile: &signedContent}, nil
+	})
+}
+
+// RpmSignFile invokes `rpmsign --addsign` under a scratch macros file
+// pointing %_gpg_name at signingStuff.GPGIdentity, so we don't disturb the
+// caller's real ~/.rpmmacros. Acquires signingSemaphore itself around the
+// rpmsign subprocess, since its caller (signArchiveContainer, via
+// TransformRpm) may already be recursing through a nested signing call on
+// the same goroutine.
+func RpmSignFile(rpmPath string, scratchDir string) error {
+	macrosPath := filepath.Join(scratchDir, "rpmmacros")
+	macros := fmt.Sprintf("%%_gpg_name %s\n", signingStuff.GPGIdentity)
+	if err := os.WriteFile(macrosPath, []byte(macros), 0644); err != nil {
+		return err
+	}
+
+	signingSemaphore <- struct{}{}
+	defer func() { <-signingSemaphore }()
+
+	process := exec.Command(
+		"rpmsign",
+		"--addsign",
+		"--macros", macrosPath,
+		"--",
+		rpmPath,
+	)
+	process.Stdout = os.Stdout
+	process.Stderr = os.Stderr
+	if err := process.Start(); err != nil {
+		return err
+	}
+	if err := process.Wait(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// quick-lint-js finds bugs in JavaScript programs.
+// Copyright (C) 2020  Matthew "strager" Glazar
+//
+// This file is part of quick-lint-js.
+//
+// quick-lint-js is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// quick-lint-js is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with quick-lint-js.  If not, see <https://www.gnu.org/licenses/>.
@@ -0,0 +1,290 @@
+// Copyright (C) 2020  Matthew "strager" Glazar
+// See end of file for extended copyright information.
+
+package main
+
+import "bytes"
+import "encoding/base64"
+import "encoding/hex"
+import "encoding/json"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "os"
+import "os/exec"
+import "sort"
+import "sync"
+
+const slsaPredicateType = "https://slsa.dev/provenance/v1"
+const inTotoStatementType = "https://in-toto.io/Statement/v1"
+const inTotoPayloadType = "application/vnd.in-toto+json"
+
+// One entry per file that TransformFile actually signed (Apple codesign,
+// auto-detected code signer, cosign, GPG, or osslsigncode), and per .deb or
+// .rpm package that signArchiveContainer re-signed. Used to build the SLSA
+// provenance attestation's subject list.
+type ProvenanceFileRecord struct {
+	Path      string
+	SHA256    SHA256Hash
+	Transform FileTransformType
+}
+
+var provenanceLog []ProvenanceFileRecord
+var provenanceLogMu sync.Mutex
+
+func RecordProvenance(deepPath DeepPath, fileHash SHA256Hash, transformType FileTransformType) {
+	if transformType == NoTransform {
+		return
+	}
+	provenanceLogMu.Lock()
+	defer provenanceLogMu.Unlock()
+	provenanceLog = append(provenanceLog, ProvenanceFileRecord{
+		Path:      deepPath.String(),
+		SHA256:    fileHash,
+		Transform: transformType,
+	})
+}
+
+func (t FileTransformType) String() string {
+	switch t {
+	case AppleCodesign:
+		return "AppleCodesign"
+	case AutoCodeSign:
+		return "AutoCodeSign"
+	case CosignSign:
+		return "CosignSign"
+	case DebSign:
+		return "DebSign"
+	case GPGSign:
+		return "GPGSign"
+	case MicrosoftOsslsigncode:
+		return "MicrosoftOsslsigncode"
+	case RpmSign:
+		return "RpmSign"
+	default:
+		return "NoTransform"
+	}
+}
+
+type inTotoStatement struct {
+	Type          string                 `json:"_type"`
+	Subject       []provenanceSubject    `json:"subject"`
+	PredicateType string                 `json:"predicateType"`
+	Predicate     slsaProvenancePredicate `json:"predicate"`
+}
+
+type provenanceSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+type slsaProvenancePredicate struct {
+	BuildDefinition slsaBuildDefinition `json:"buildDefinition"`
+	RunDetails      slsaRunDetails      `json:"runDetails"`
+}
+
+type slsaBuildDefinition struct {
+	BuildType          string                 `json:"buildType"`
+	InternalParameters map[string]interface{} `json:"internalParameters"`
+	SignedFiles        []provenanceSignedFile `json:"resolvedDependencies"`
+}
+
+type provenanceSignedFile struct {
+	Name      string `json:"name"`
+	Digest    map[string]string `json:"digest"`
+	Transform string `json:"annotations"`
+}
+
+type slsaRunDetails struct {
+	Builder slsaBuilder `json:"builder"`
+}
+
+type slsaBuilder struct {
+	ID string `json:"id"`
+}
+
+// GenerateProvenance builds a SLSA v1.0 provenance statement for every file
+// RecordProvenance saw, wraps it in a DSSE envelope, signs the envelope with
+// the same GPG identity used for SHA256SUMS.asc, and writes it (one JSON
+// object per line, per the in-toto attestation bundle convention) to
+// outPath.
+func GenerateProvenance(hashesPath string, outPath string, builderURI string) error {
+	provenanceLogMu.Lock()
+	records := append([]ProvenanceFileRecord(nil), provenanceLog...)
+	provenanceLogMu.Unlock()
+
+	sort.Slice(records, func(i, j int) bool { return records[i].Path < records[j].Path })
+
+	subjects := make([]provenanceSubject, 0, len(records))
+	signedFiles := make([]provenanceSignedFile, 0, len(records))
+	for _, record := range records {
+		digest := map[string]string{"sha256": hex.EncodeToString(record.SHA256[:])}
+		subjects = append(subjects, provenanceSubject{Name: record.Path, Digest: digest})
+		signedFiles = append(signedFiles, provenanceSignedFile{
+			Name:      record.Path,
+			Digest:    digest,
+			Transform: record.Transform.String(),
+		})
+	}
+
+	if builderURI == "" {
+		builderURI = "https://github.com/quick-lint/quick-lint-js/dist/sign-release.go"
+	}
+
+	statement := inTotoStatement{
+		Type:          inTotoStatementType,
+		Subject:       subjects,
+		PredicateType: slsaPredicateType,
+		Predicate: slsaProvenancePredicate{
+			BuildDefinition: slsaBuildDefinition{
+				BuildType: "https://quick-lint-js.com/dist/sign-release",
+				InternalParameters: map[string]interface{}{
+					"appleCodesignIdentity": signingStuff.AppleCodesignIdentity,
+					"certificateSHA1":       hex.EncodeToString(signingStuff.CertificateSHA1Hash[:]),
+					"gpgIdentity":           signingStuff.GPGIdentity,
+				},
+				SignedFiles: signedFiles,
+			},
+			RunDetails: slsaRunDetails{
+				Builder: slsaBuilder{ID: builderURI},
+			},
+		},
+	}
+
+	payload, err := json.Marshal(statement)
+	if err != nil {
+		return err
+	}
+
+	envelope, err := signDSSEEnvelope(inTotoPayloadType, payload)
+	if err != nil {
+		return err
+	}
+	envelopeJSON, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+
+	envelopeLine := append(envelopeJSON, '\n')
+	return writeFileAtomic(outPath, 0644, func(w io.Writer) error {
+		_, err := w.Write(envelopeLine)
+		return err
+	})
+}
+
+type dsseEnvelope struct {
+	PayloadType string          `json:"payloadType"`
+	Payload     string          `json:"payload"`
+	Signatures  []dsseSignature `json:"signatures"`
+}
+
+type dsseSignature struct {
+	KeyID string `json:"keyid,omitempty"`
+	Sig   string `json:"sig"`
+}
+
+// signDSSEEnvelope signs payload per the DSSE spec
+// (https://github.com/secure-systems-lab/dsse): the pre-authentication
+// encoding (PAE) of (payloadType, payload) is what actually gets signed, not
+// the raw payload.
+func signDSSEEnvelope(payloadType string, payload []byte) (dsseEnvelope, error) {
+	pae := dssePAE(payloadType, payload)
+
+	tempFile, err := ioutil.TempFile("", "quick-lint-js-sign-release-provenance")
+	if err != nil {
+		return dsseEnvelope{}, err
+	}
+	defer os.Remove(tempFile.Name())
+	if _, err := tempFile.Write(pae); err != nil {
+		tempFile.Close()
+		return dsseEnvelope{}, err
+	}
+	tempFile.Close()
+
+	sigPath := tempFile.Name() + ".sig"
+	defer os.Remove(sigPath)
+	process := exec.Command(
+		"gpg",
+		"--local-user", signingStuff.GPGIdentity,
+		"--detach-sign",
+		"--output", sigPath,
+		"--",
+		tempFile.Name(),
+	)
+	process.Stdout = os.Stdout
+	process.Stderr = os.Stderr
+	if err := process.Start(); err != nil {
+		return dsseEnvelope{}, err
+	}
+	if err := process.Wait(); err != nil {
+		return dsseEnvelope{}, err
+	}
+
+	sig, err := os.ReadFile(sigPath)
+	if err != nil {
+		return dsseEnvelope{}, err
+	}
+
+	return dsseEnvelope{
+		PayloadType: payloadType,
+		Payload:     base64.StdEncoding.EncodeToString(payload),
+		Signatures: []dsseSignature{
+			{KeyID: signingStuff.GPGIdentity, Sig: base64.StdEncoding.EncodeToString(sig)},
+		},
+	}, nil
+}
+
+func dssePAE(payloadType string, payload []byte) []byte {
+	var pae bytes.Buffer
+	fmt.Fprintf(&pae, "DSSEv1 %d %s %d ", len(payloadType), payloadType, len(payload))
+	pae.Write(payload)
+	return pae.Bytes()
+}
+
+// VerifyProvenance re-hashes every subject the provenance statement names --
+// DeepHasher now follows DeepPath's "!"-joined nesting into .tar.gz/.zip/.deb
+// members, not just top-level files -- and fails if any no longer matches,
+// so a corrupted or tampered destinationDir is caught before release
+// artifacts are published. A record DeepHasher can't resolve at all is
+// itself an error rather than a silent skip: every record is supposed to
+// name either a real file or a member of an archive format DeepHasher knows
+// how to open, so a miss means destinationDir is missing something
+// provenance says was shipped.
+func VerifyProvenance(destinationDir string, provenancePath string) error {
+	provenanceLogMu.Lock()
+	records := append([]ProvenanceFileRecord(nil), provenanceLog...)
+	provenanceLogMu.Unlock()
+
+	hasher := NewDeepHasher()
+	if err := hasher.DeepHashDirectory(destinationDir); err != nil {
+		return err
+	}
+	for _, record := range records {
+		hash, ok := hasher.Hashes[NewDeepPath(record.Path).String()]
+		if !ok {
+			return fmt.Errorf("provenance mismatch: %s is missing from %s", record.Path, destinationDir)
+		}
+		if hash != record.SHA256 {
+			return fmt.Errorf("provenance mismatch: %s no longer matches its recorded SHA-256", record.Path)
+		}
+	}
+	return nil
+}
+
+// quick-lint-js finds bugs in JavaScript programs.
+// Copyright (C) 2020  Matthew "strager" Glazar
+//
+// This file is part of quick-lint-js.
+//
+// quick-lint-js is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// quick-lint-js is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with quick-lint-js.  If not, see <https://www.gnu.org/licenses/>.
@@ -0,0 +1,312 @@
+// Copyright (C) 2020  Matthew "strager" Glazar
+// See end of file for extended copyright information.
+
+package main
+
+import "bytes"
+import "crypto/sha256"
+import "debug/macho"
+import "debug/pe"
+import "encoding/binary"
+import "errors"
+import "fmt"
+import "io/fs"
+import "io/ioutil"
+import "log"
+import "os"
+import "os/exec"
+import "path/filepath"
+import "strings"
+
+// VerifyReproducibleBuild re-runs buildScript against gitRef to produce an
+// independent copy of every binary in destinationDir, strips the
+// already-applied signatures (Apple codesign superblock, Authenticode
+// WIN_CERT table, GPG ".asc" siblings) from the shipped copies, and compares
+// SHA-256 hashes. This is modeled on Go's gorebuild: it doesn't trust
+// CheckDoubleSigning or the signing pipeline itself, only an independently
+// produced build.
+func VerifyReproducibleBuild(destinationDir string, gitRef string, buildScript string) error {
+	if buildScript == "" {
+		return fmt.Errorf("-BuildScript must be set to use -Verify")
+	}
+
+	rebuildDir, err := ioutil.TempDir("", "quick-lint-js-rebuild")
+	if err != nil {
+		return err
+	}
+	addTempDir(rebuildDir)
+
+	log.Printf("rebuilding %s via %s into %s\n", gitRef, buildScript, rebuildDir)
+	buildCommand := exec.Command(buildScript, gitRef, rebuildDir)
+	buildCommand.Stdout = os.Stdout
+	buildCommand.Stderr = os.Stderr
+	if err := buildCommand.Run(); err != nil {
+		return fmt.Errorf("build script failed: %w", err)
+	}
+
+	anyMismatch := false
+	err = filepath.Walk(destinationDir, func(shippedPath string, info fs.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		relativePath, err := filepath.Rel(destinationDir, shippedPath)
+		if err != nil {
+			return err
+		}
+
+		// Detached signatures, checksums, and provenance have no
+		// counterpart in a freshly-built tree; only binaries do.
+		if strings.HasSuffix(relativePath, ".asc") ||
+			strings.HasSuffix(relativePath, ".cosign.bundle") ||
+			strings.HasSuffix(relativePath, ".sig") ||
+			relativePath == "SHA256SUMS" ||
+			relativePath == "SHA512SUMS" ||
+			relativePath == "BLAKE2B256SUMS" ||
+			relativePath == "provenance.intoto.jsonl" {
+			return nil
+		}
+
+		rebuiltPath := filepath.Join(rebuildDir, relativePath)
+		if _, err := os.Stat(rebuiltPath); errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+
+		shippedHash, err := hashStrippedFile(shippedPath)
+		if err != nil {
+			return err
+		}
+		rebuiltHash, err := hashStrippedFile(rebuiltPath)
+		if err != nil {
+			return err
+		}
+
+		status := "MISMATCH"
+		if shippedHash == rebuiltHash {
+			status = "MATCH"
+		} else {
+			anyMismatch = true
+		}
+		log.Printf("%s: %s\n", status, relativePath)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if anyMismatch {
+		return fmt.Errorf("one or more rebuilt binaries did not reproduce the signed release")
+	}
+	return nil
+}
+
+// hashStrippedFile reads path and hashes its content after removing any
+// signature that TransformFile would have added, so a freshly-built
+// (unsigned) binary can be compared byte-for-byte against a signed one.
+func hashStrippedFile(path string) (SHA256Hash, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return SHA256Hash{}, err
+	}
+
+	stripped := content
+	if looksLikeMachO(content) {
+		stripped, err = stripAppleCodesignSuperblock(content)
+		if err != nil {
+			return SHA256Hash{}, err
+		}
+	} else if looksLikePE(content) {
+		stripped, err = stripAuthenticodeCertTable(content)
+		if err != nil {
+			return SHA256Hash{}, err
+		}
+	}
+
+	return sha256.Sum256(stripped), nil
+}
+
+func looksLikeMachO(content []byte) bool {
+	if len(content) < 4 {
+		return false
+	}
+	magic := binary.BigEndian.Uint32(content[:4])
+	switch magic {
+	case 0xfeedface, 0xfeedfacf, 0xcafebabe, 0xcefaedfe, 0xcffaedfe, 0xbebafeca:
+		return true
+	default:
+		return false
+	}
+}
+
+func looksLikeFatMachO(content []byte) bool {
+	if len(content) < 4 {
+		return false
+	}
+	switch binary.BigEndian.Uint32(content[:4]) {
+	case 0xcafebabe, 0xbebafeca:
+		return true
+	default:
+		return false
+	}
+}
+
+// stripAppleCodesignSuperblock removes the LC_CODE_SIGNATURE blob codesign
+// appends to each Mach-O slice. We parse the load commands via debug/macho
+// to find the signature's real dataoff rather than scanning for its magic
+// number: the magic can appear incidentally inside a slice's data or string
+// sections, and a universal ("fat") binary carries one independently
+// signed slice per architecture, not one trailing signature for the whole
+// file, so each slice has to be stripped at its own offset.
+func stripAppleCodesignSuperblock(content []byte) ([]byte, error) {
+	if looksLikeFatMachO(content) {
+		fat, err := macho.NewFatFile(bytes.NewReader(content))
+		if err != nil {
+			return nil, err
+		}
+		defer fat.Close()
+
+		stripped := make([]byte, 0, len(content))
+		for _, arch := range fat.Arches {
+			slice, err := stripMachOSliceCodeSignature(content[arch.Offset : arch.Offset+arch.Size])
+			if err != nil {
+				return nil, err
+			}
+			stripped = append(stripped, slice...)
+		}
+		return stripped, nil
+	}
+
+	return stripMachOSliceCodeSignature(content)
+}
+
+// stripMachOSliceCodeSignature strips the LC_CODE_SIGNATURE data, if any,
+// from a single (non-fat) Mach-O image.
+func stripMachOSliceCodeSignature(slice []byte) ([]byte, error) {
+	const loadCmdCodeSignature = 0x1d // LC_CODE_SIGNATURE; not special-cased by debug/macho.
+
+	file, err := macho.NewFile(bytes.NewReader(slice))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	for _, load := range file.Loads {
+		raw := load.Raw()
+		if len(raw) < 16 || file.ByteOrder.Uint32(raw[0:4]) != loadCmdCodeSignature {
+			continue
+		}
+		dataoff := file.ByteOrder.Uint32(raw[8:12])
+		if int(dataoff) <= len(slice) {
+			return slice[:dataoff], nil
+		}
+	}
+	return slice, nil
+}
+
+func looksLikePE(content []byte) bool {
+	return len(content) > 2 && content[0] == 'M' && content[1] == 'Z'
+}
+
+// stripAuthenticodeCertTable zeroes the Certificate Table data directory
+// entry and the PE checksum field, then truncates the file at the start of
+// the certificate table, per the Authenticode spec, so the hash matches
+// what osslsigncode/our own PE signer hashed before signing: both fields
+// are excluded from the Authenticode digest (the checksum because it can't
+// describe its own file, the directory entry because it names the very
+// table being stripped), and debug/pe only hands back their parsed values,
+// not their offsets into content, so we locate those offsets ourselves the
+// same way stripMachOSliceCodeSignature reads a load command's dataoff
+// directly off the raw bytes instead of relying on debug/macho to expose
+// one.
+func stripAuthenticodeCertTable(content []byte) ([]byte, error) {
+	file, err := pe.NewFile(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// Offsets of CheckSum and DataDirectory[0], relative to the start of
+	// the Optional Header, per the PE spec. Before CheckSum, PE32's extra
+	// 4-byte BaseOfData field makes up for its 4-byte (vs 8-byte) ImageBase,
+	// which is why CheckSum lands at the same offset in both; after it, the
+	// four SizeOf{Stack,Heap}{Reserve,Commit} fields are 4 vs 8 bytes each,
+	// which is why DataDirectory doesn't.
+	const checkSumOffset32 = 64
+	const dataDirectoryOffset32 = 96
+	const checkSumOffset64 = 64
+	const dataDirectoryOffset64 = 112
+	const dataDirectoryEntrySize = 8 // uint32 VirtualAddress + uint32 Size
+
+	var certTableOffset, certTableSize uint32
+	var checkSumOffset, securityDirOffset int
+	switch optionalHeader := file.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		dir := optionalHeader.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_SECURITY]
+		certTableOffset, certTableSize = dir.VirtualAddress, dir.Size
+		checkSumOffset = checkSumOffset32
+		securityDirOffset = dataDirectoryOffset32 + pe.IMAGE_DIRECTORY_ENTRY_SECURITY*dataDirectoryEntrySize
+	case *pe.OptionalHeader64:
+		dir := optionalHeader.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_SECURITY]
+		certTableOffset, certTableSize = dir.VirtualAddress, dir.Size
+		checkSumOffset = checkSumOffset64
+		securityDirOffset = dataDirectoryOffset64 + pe.IMAGE_DIRECTORY_ENTRY_SECURITY*dataDirectoryEntrySize
+	default:
+		return content, nil
+	}
+	if certTableSize == 0 || int(certTableOffset) > len(content) {
+		return content, nil
+	}
+
+	optionalHeaderOffset, err := peOptionalHeaderOffset(content)
+	if err != nil {
+		return nil, err
+	}
+	if optionalHeaderOffset+securityDirOffset+dataDirectoryEntrySize > int(certTableOffset) ||
+		optionalHeaderOffset+checkSumOffset+4 > int(certTableOffset) {
+		return nil, fmt.Errorf("PE optional header fields overlap the certificate table")
+	}
+
+	stripped := make([]byte, certTableOffset)
+	copy(stripped, content[:certTableOffset])
+	binary.LittleEndian.PutUint32(stripped[optionalHeaderOffset+checkSumOffset:], 0)
+	for i := 0; i < dataDirectoryEntrySize; i++ {
+		stripped[optionalHeaderOffset+securityDirOffset+i] = 0
+	}
+	return stripped, nil
+}
+
+// peOptionalHeaderOffset returns content's Optional Header offset. The DOS
+// header's e_lfanew field, a fixed 4 bytes at offset 0x3c, points to the PE
+// signature; the Optional Header follows that signature and the
+// fixed-size COFF File Header.
+func peOptionalHeaderOffset(content []byte) (int, error) {
+	const e_lfanewOffset = 0x3c
+	const peSignatureSize = 4
+	const coffFileHeaderSize = 20
+
+	if len(content) < e_lfanewOffset+4 {
+		return 0, fmt.Errorf("PE file too small to contain a DOS header")
+	}
+	peHeaderOffset := int(binary.LittleEndian.Uint32(content[e_lfanewOffset : e_lfanewOffset+4]))
+	optionalHeaderOffset := peHeaderOffset + peSignatureSize + coffFileHeaderSize
+	if optionalHeaderOffset > len(content) {
+		return 0, fmt.Errorf("PE optional header offset %d is past end of file", optionalHeaderOffset)
+	}
+	return optionalHeaderOffset, nil
+}
+
+// quick-lint-js finds bugs in JavaScript programs.
+// Copyright (C) 2020  Matthew "strager" Glazar
+//
+// This file is part of quick-lint-js.
+//
+// quick-lint-js is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// quick-lint-js is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with quick-lint-js.  If not, see <https://www.gnu.org/licenses/>.
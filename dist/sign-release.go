@@ -7,12 +7,15 @@ import "archive/tar"
 import "archive/zip"
 import "bytes"
 import "compress/gzip"
+import "context"
 import "crypto/sha1"
 import "crypto/sha256"
+import "crypto/sha512"
 import "encoding/hex"
 import "errors"
 import "flag"
 import "fmt"
+import "hash"
 import "io"
 import "io/fs"
 import "io/ioutil"
@@ -20,10 +23,19 @@ import "log"
 import "os"
 import "os/exec"
 import "path/filepath"
+import "runtime"
 import "strings"
+import "sync"
 import "time"
 import _ "embed"
 
+import "github.com/blakesmith/ar"
+import "golang.org/x/crypto/blake2b"
+import "golang.org/x/sync/errgroup"
+
+import "quick-lint-js.com/dist/authenticode"
+import "quick-lint-js.com/dist/trustbundle"
+
 //go:embed certificates/quick-lint-js.cer
 var AppleCodesignCertificate []byte
 
@@ -34,41 +46,156 @@ type SigningStuff struct {
 	AppleCodesignIdentity string // Common Name from the macOS Keychain.
 	Certificate           []byte
 	CertificateSHA1Hash   [20]byte
+	CosignKey             string // PKCS#11/KMS URI, or "" for keyless (Fulcio/Rekor) signing.
 	GPGIdentity           string // Fingerprint or email or name.
 	GPGKey                []byte
 	PrivateKeyPKCS12Path  string
+	PKCS11ModulePath      string // Path to the PKCS#11 module .so used to sign Linux ELF binaries.
+	PKCS11TokenLabel      string
+	PKCS11KeyLabel        string
 }
 
 // Key: SHA256 hash of original file
 // Value: contents of transformed (signed) file
-var TransformCache map[SHA256Hash]FileTransformResult = make(map[SHA256Hash]FileTransformResult)
+//
+// Accessed concurrently by the signing worker pool, so all access goes
+// through sync.Map instead of a plain map.
+var TransformCache sync.Map
+
+// Deduplicates in-flight signing work: if two files with identical content
+// (e.g. the same quick-lint-js.exe embedded in both the x86 and x64
+// chocolatey packages) are submitted to the pool at the same time, only the
+// first spawns a codesign/gpg/osslsigncode process; the rest wait for it and
+// reuse its result.
+var inFlightTransforms sync.Map // SHA256Hash -> *inFlightTransform
+
+type inFlightTransform struct {
+	done   chan struct{}
+	result FileTransformResult
+	err    error
+}
+
+// Bounds how many signing subprocesses (codesign, gpg, osslsigncode) run at
+// once. Sized by the -j flag in main.
+var signingSemaphore chan struct{}
+
+// If true, shell out to osslsigncode for Authenticode signing instead of
+// using the pure-Go authenticode package. Defaults to true: the native
+// signer's hand-rolled PKCS#7 SignedData (see authenticode/pkcs7.go) hasn't
+// been checked against a real signtool/Authenticode verifier yet, so
+// osslsigncode remains the trusted default until it has.
+var useOsslsigncode bool
+
+// RFC3161 timestamp authority used by the native Authenticode signer.
+var authenticodeTimestampURL string
+
+// If true, gpgSigner (and the verifier GPGVerifySignature builds) sign/verify
+// with an in-memory OpenPGP key instead of shelling out to gpg(1). A
+// package-level var, like useOsslsigncode, so GPGVerifySignature can read it
+// without going through gpgSigner, which is nil in the "qljs-sign verify"
+// path.
+var useInProcessGPG bool
+
+// filesToTransform is mutated (via delete) from multiple worker goroutines.
+var filesToTransformMu sync.Mutex
 
 var signingStuff SigningStuff
 
 var ProgramStartTime time.Time = time.Now()
 var TempDirs []string
+var TempDirsMu sync.Mutex
 
 func main() {
 	defer RemoveTempDirs()
 
+	// "qljs-sign verify <artifact>..." must never see signingStuff.Certificate
+	// or signingStuff.GPGKey set: those hold this binary's own signing
+	// identity, and GPGVerifySignature/MicrosoftOsslsigncodeVerifyFile only
+	// fall back to the trustbundle package when they're empty. Handling it
+	// before that assignment is what makes verification work offline, from
+	// just this binary, with no other flags or files.
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		runVerifyCommand(os.Args[2:])
+		return
+	}
+
 	signingStuff.Certificate = AppleCodesignCertificate
 	signingStuff.GPGKey = QLJSGPGKey
 
+	concurrency := 0
+	useCosign := false
+	useAutoCodeSign := false
+	builderURI := ""
+	verifyMode := false
+	buildScript := ""
+	resumeMode := false
+	flag.BoolVar(&resumeMode, "resume", false, "skip re-signing a top-level archive whose output already exists, has no leftover \".new\" file (an interrupted write), and whose GPG signature still verifies; for resuming a crashed run without redoing hours of PKCS#12/HSM work")
+	flag.BoolVar(&useInProcessGPG, "UseInProcessGPG", false, "sign with an in-memory OpenPGP key instead of shelling out to gpg(1); for CI containers without a gpg-agent")
+	flag.StringVar(&builderURI, "Builder", "", "URI identifying the builder, recorded in the SLSA provenance attestation")
+	flag.StringVar(&buildScript, "BuildScript", "", "script invoked as 'BuildScript <gitRef> <outDir>' to independently rebuild a release for -Verify")
+	flag.BoolVar(&verifyMode, "Verify", false, "instead of signing, cross-check a previously-signed destinationDir against an independent rebuild of gitRef")
 	flag.StringVar(&signingStuff.AppleCodesignIdentity, "AppleCodesignIdentity", "", "")
+	flag.StringVar(&signingStuff.CosignKey, "CosignKey", "", "PKCS#11/KMS URI for cosign; if empty, cosign uses the keyless (Fulcio/Rekor) OIDC flow")
 	flag.StringVar(&signingStuff.GPGIdentity, "GPGIdentity", "", "")
 	flag.StringVar(&signingStuff.PrivateKeyPKCS12Path, "PrivateKeyPKCS12", "", "")
+	flag.StringVar(&signingStuff.PKCS11ModulePath, "PKCS11ModulePath", "", "path to the PKCS#11 module .so, for signing Linux ELF binaries with a hardware token")
+	flag.StringVar(&signingStuff.PKCS11TokenLabel, "PKCS11TokenLabel", "", "")
+	flag.StringVar(&signingStuff.PKCS11KeyLabel, "PKCS11KeyLabel", "", "")
+	flag.BoolVar(&useCosign, "UseCosign", false, "sign Linux ELF and .node binaries with cosign instead of GPG")
+	flag.BoolVar(&useAutoCodeSign, "UseAutoCodeSign", false, "pick the Apple codesign/Authenticode/PKCS#11 backend by sniffing each binary's file magic instead of trusting filesToTransform's platform guess")
+	flag.BoolVar(&useOsslsigncode, "UseOsslsigncode", true, "shell out to osslsigncode instead of the built-in Authenticode signer (the built-in signer is unverified against a real Authenticode verifier; pass -UseOsslsigncode=false to try it)")
+	flag.StringVar(&authenticodeTimestampURL, "TimestampURL", "http://timestamp.digicert.com", "RFC 3161 timestamp authority for Authenticode countersignatures")
+	flag.IntVar(&concurrency, "j", runtime.NumCPU(), "number of signing jobs (codesign/gpg/osslsigncode) to run concurrently")
 	flag.Parse()
 	if flag.NArg() != 2 {
 		os.Stderr.WriteString(fmt.Sprintf("error: source and destination directories\n"))
 		os.Exit(2)
 	}
 
+	if verifyMode {
+		destinationDir := flag.Args()[0]
+		gitRef := flag.Args()[1]
+		if err := VerifyReproducibleBuild(destinationDir, gitRef, buildScript); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	signingSemaphore = make(chan struct{}, concurrency)
+
+	gpgSigner = &GPGSigner{
+		Identity:     signingStuff.GPGIdentity,
+		Key:          signingStuff.GPGKey,
+		UseInProcess: useInProcessGPG,
+	}
+
+	if useCosign {
+		for path, transformType := range filesToTransform {
+			if transformType == GPGSign {
+				filesToTransform[path] = CosignSign
+			}
+		}
+	}
+
+	if useAutoCodeSign {
+		for path, transformType := range filesToTransform {
+			if transformType == AppleCodesign || transformType == MicrosoftOsslsigncode || transformType == GPGSign {
+				filesToTransform[path] = AutoCodeSign
+			}
+		}
+	}
+
 	signingStuff.CertificateSHA1Hash = sha1.Sum(AppleCodesignCertificate)
 
 	sourceDir := flag.Args()[0]
 	destinationDir := flag.Args()[1]
 
-	hashes := ListOfHashes{}
+	hashes := NewListOfHashes(SHA256, SHA512, BLAKE2b_256)
+	var hashesMu sync.Mutex
+	group, _ := errgroup.WithContext(context.Background())
 	err := filepath.Walk(sourceDir, func(sourcePath string, sourceInfo fs.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -85,20 +212,54 @@ func main() {
 				return err
 			}
 		} else {
-			err = CopyFileOrTransformArchive(NewDeepPath(relativePath), sourcePath, destinationPath, sourceInfo)
-			if err != nil {
-				return err
-			}
-
-			if err := hashes.AddHashOfFile(destinationPath, relativePath); err != nil {
-				return err
-			}
+			// Submitting to the errgroup here (rather than transforming
+			// inline) lets independent top-level archives -- the npm
+			// tarball, the vsix, the chocolatey nupkg, the manual
+			// tarballs -- sign in parallel, bounded by signingSemaphore.
+			group.Go(func() error {
+				if resumeMode && canResumeSkip(destinationPath, relativePath) {
+					log.Printf("resume: already signed, skipping: %s\n", destinationPath)
+					markArchiveResumedAsTransformed(relativePath)
+				} else {
+					if err := CopyFileOrTransformArchive(NewDeepPath(relativePath), sourcePath, destinationPath, sourceInfo); err != nil {
+						return err
+					}
+
+					if PathLooksLikeTarGz(relativePath) || PathLooksLikeZip(relativePath) {
+						log.Printf("signing with GPG: %s\n", destinationPath)
+						if _, err := gpgSigner.SignFileDetached(destinationPath); err != nil {
+							return err
+						}
+						if err := gpgSigner.VerifyDetachedSignature(destinationPath, destinationPath+".asc"); err != nil {
+							return err
+						}
+					}
+				}
+
+				hashesMu.Lock()
+				defer hashesMu.Unlock()
+				if err := hashes.AddHashOfFile(destinationPath, relativePath); err != nil {
+					return err
+				}
+				for _, suffix := range signatureSiblingSuffixes {
+					if _, err := os.Stat(destinationPath + suffix); errors.Is(err, fs.ErrNotExist) {
+						continue
+					}
+					if err := hashes.AddHashOfFile(destinationPath+suffix, relativePath+suffix); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
 		}
 		return nil
 	})
 	if err != nil {
 		log.Fatal(err)
 	}
+	if err := group.Wait(); err != nil {
+		log.Fatal(err)
+	}
 
 	if err := CheckUnsignedFiles(); err != nil {
 		log.Fatal(err)
@@ -107,8 +268,8 @@ func main() {
 		log.Fatal(err)
 	}
 
-	hashesPath := filepath.Join(destinationDir, "SHA256SUMS")
-	if err := hashes.DumpSHA256HashesToFile(hashesPath); err != nil {
+	hashesPath := filepath.Join(destinationDir, SHA256.sumsFileName())
+	if err := hashes.DumpChecksumFiles(destinationDir); err != nil {
 		log.Fatal(err)
 	}
 
@@ -120,7 +281,18 @@ func main() {
 		log.Fatal(err)
 	}
 
-	if err := VerifySHA256SUMSFile(hashesPath); err != nil {
+	for _, algo := range hashes.Algos {
+		if err := VerifyChecksumFile(filepath.Join(destinationDir, algo.sumsFileName()), algo); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	provenancePath := filepath.Join(destinationDir, "provenance.intoto.jsonl")
+	log.Printf("writing SLSA provenance: %s\n", provenancePath)
+	if err := GenerateProvenance(hashesPath, provenancePath, builderURI); err != nil {
+		log.Fatal(err)
+	}
+	if err := VerifyProvenance(destinationDir, provenancePath); err != nil {
 		log.Fatal(err)
 	}
 
@@ -134,6 +306,12 @@ func main() {
 	}
 }
 
+func addTempDir(tempDir string) {
+	TempDirsMu.Lock()
+	defer TempDirsMu.Unlock()
+	TempDirs = append(TempDirs, tempDir)
+}
+
 func RemoveTempDirs() {
 	for _, tempDir := range TempDirs {
 		os.RemoveAll(tempDir)
@@ -145,45 +323,54 @@ type FileTransformType int
 const (
 	NoTransform FileTransformType = iota
 	AppleCodesign
+	AutoCodeSign
+	CosignSign
+	DebSign
 	GPGSign
 	MicrosoftOsslsigncode
+	RpmSign
 )
 
-var filesToTransform map[DeepPath]FileTransformType = map[DeepPath]FileTransformType{
-	NewDeepPath3("chocolatey/quick-lint-js.nupkg", "tools/windows-x64.zip", "bin/quick-lint-js.exe"):              MicrosoftOsslsigncode,
-	NewDeepPath3("chocolatey/quick-lint-js.nupkg", "tools/windows-x86.zip", "bin/quick-lint-js.exe"):              MicrosoftOsslsigncode,
-	NewDeepPath2("manual/linux-aarch64.tar.gz", "quick-lint-js/bin/quick-lint-js"):                                GPGSign,
-	NewDeepPath2("manual/linux-armhf.tar.gz", "quick-lint-js/bin/quick-lint-js"):                                  GPGSign,
-	NewDeepPath2("manual/linux.tar.gz", "quick-lint-js/bin/quick-lint-js"):                                        GPGSign,
-	NewDeepPath2("manual/macos-aarch64.tar.gz", "quick-lint-js/bin/quick-lint-js"):                                AppleCodesign,
-	NewDeepPath2("manual/macos.tar.gz", "quick-lint-js/bin/quick-lint-js"):                                        AppleCodesign,
-	NewDeepPath2("manual/windows-arm64.zip", "bin/quick-lint-js.exe"):                                             MicrosoftOsslsigncode,
-	NewDeepPath2("manual/windows-arm.zip", "bin/quick-lint-js.exe"):                                               MicrosoftOsslsigncode,
-	NewDeepPath2("manual/windows-x86.zip", "bin/quick-lint-js.exe"):                                               MicrosoftOsslsigncode,
-	NewDeepPath2("manual/windows.zip", "bin/quick-lint-js.exe"):                                                   MicrosoftOsslsigncode,
-	NewDeepPath2("npm/quick-lint-js-2.3.0.tgz", "package/darwin-arm64/bin/quick-lint-js"):                         AppleCodesign,
-	NewDeepPath2("npm/quick-lint-js-2.3.0.tgz", "package/darwin-x64/bin/quick-lint-js"):                           AppleCodesign,
-	NewDeepPath2("npm/quick-lint-js-2.3.0.tgz", "package/linux-arm/bin/quick-lint-js"):                            GPGSign,
-	NewDeepPath2("npm/quick-lint-js-2.3.0.tgz", "package/linux-arm64/bin/quick-lint-js"):                          GPGSign,
-	NewDeepPath2("npm/quick-lint-js-2.3.0.tgz", "package/linux-x64/bin/quick-lint-js"):                            GPGSign,
-	NewDeepPath2("npm/quick-lint-js-2.3.0.tgz", "package/win32-arm64/bin/quick-lint-js.exe"):                      MicrosoftOsslsigncode,
-	NewDeepPath2("npm/quick-lint-js-2.3.0.tgz", "package/win32-ia32/bin/quick-lint-js.exe"):                       MicrosoftOsslsigncode,
-	NewDeepPath2("npm/quick-lint-js-2.3.0.tgz", "package/win32-x64/bin/quick-lint-js.exe"):                        MicrosoftOsslsigncode,
-	NewDeepPath2("vscode/quick-lint-js-2.3.0.vsix", "extension/dist/quick-lint-js-vscode-node_darwin-arm64.node"): AppleCodesign,
-	NewDeepPath2("vscode/quick-lint-js-2.3.0.vsix", "extension/dist/quick-lint-js-vscode-node_darwin-x64.node"):   AppleCodesign,
-	NewDeepPath2("vscode/quick-lint-js-2.3.0.vsix", "extension/dist/quick-lint-js-vscode-node_linux-arm.node"):    GPGSign,
-	NewDeepPath2("vscode/quick-lint-js-2.3.0.vsix", "extension/dist/quick-lint-js-vscode-node_linux-arm64.node"):  GPGSign,
-	NewDeepPath2("vscode/quick-lint-js-2.3.0.vsix", "extension/dist/quick-lint-js-vscode-node_linux-x64.node"):    GPGSign,
-	NewDeepPath2("vscode/quick-lint-js-2.3.0.vsix", "extension/dist/quick-lint-js-vscode-node_win32-arm.node"):    MicrosoftOsslsigncode,
-	NewDeepPath2("vscode/quick-lint-js-2.3.0.vsix", "extension/dist/quick-lint-js-vscode-node_win32-arm64.node"):  MicrosoftOsslsigncode,
-	NewDeepPath2("vscode/quick-lint-js-2.3.0.vsix", "extension/dist/quick-lint-js-vscode-node_win32-ia32.node"):   MicrosoftOsslsigncode,
-	NewDeepPath2("vscode/quick-lint-js-2.3.0.vsix", "extension/dist/quick-lint-js-vscode-node_win32-x64.node"):    MicrosoftOsslsigncode,
+// Keyed by DeepPath.String() rather than DeepPath itself: DeepPath spills
+// to a heap slice past its inline capacity (see DeepPath's definition),
+// which makes it uncomparable and therefore unusable as a map key.
+var filesToTransform map[string]FileTransformType = map[string]FileTransformType{
+	NewDeepPath3("chocolatey/quick-lint-js.nupkg", "tools/windows-x64.zip", "bin/quick-lint-js.exe").String():              MicrosoftOsslsigncode,
+	NewDeepPath3("chocolatey/quick-lint-js.nupkg", "tools/windows-x86.zip", "bin/quick-lint-js.exe").String():              MicrosoftOsslsigncode,
+	NewDeepPath2("manual/linux-aarch64.tar.gz", "quick-lint-js/bin/quick-lint-js").String():                                GPGSign,
+	NewDeepPath2("manual/linux-armhf.tar.gz", "quick-lint-js/bin/quick-lint-js").String():                                  GPGSign,
+	NewDeepPath2("manual/linux.tar.gz", "quick-lint-js/bin/quick-lint-js").String():                                        GPGSign,
+	NewDeepPath2("manual/macos-aarch64.tar.gz", "quick-lint-js/bin/quick-lint-js").String():                                AppleCodesign,
+	NewDeepPath2("manual/macos.tar.gz", "quick-lint-js/bin/quick-lint-js").String():                                        AppleCodesign,
+	NewDeepPath2("manual/windows-arm64.zip", "bin/quick-lint-js.exe").String():                                             MicrosoftOsslsigncode,
+	NewDeepPath2("manual/windows-arm.zip", "bin/quick-lint-js.exe").String():                                               MicrosoftOsslsigncode,
+	NewDeepPath2("manual/windows-x86.zip", "bin/quick-lint-js.exe").String():                                               MicrosoftOsslsigncode,
+	NewDeepPath2("manual/windows.zip", "bin/quick-lint-js.exe").String():                                                   MicrosoftOsslsigncode,
+	NewDeepPath2("npm/quick-lint-js-2.3.0.tgz", "package/darwin-arm64/bin/quick-lint-js").String():                         AppleCodesign,
+	NewDeepPath2("npm/quick-lint-js-2.3.0.tgz", "package/darwin-x64/bin/quick-lint-js").String():                           AppleCodesign,
+	NewDeepPath2("npm/quick-lint-js-2.3.0.tgz", "package/linux-arm/bin/quick-lint-js").String():                            GPGSign,
+	NewDeepPath2("npm/quick-lint-js-2.3.0.tgz", "package/linux-arm64/bin/quick-lint-js").String():                          GPGSign,
+	NewDeepPath2("npm/quick-lint-js-2.3.0.tgz", "package/linux-x64/bin/quick-lint-js").String():                            GPGSign,
+	NewDeepPath2("npm/quick-lint-js-2.3.0.tgz", "package/win32-arm64/bin/quick-lint-js.exe").String():                      MicrosoftOsslsigncode,
+	NewDeepPath2("npm/quick-lint-js-2.3.0.tgz", "package/win32-ia32/bin/quick-lint-js.exe").String():                       MicrosoftOsslsigncode,
+	NewDeepPath2("npm/quick-lint-js-2.3.0.tgz", "package/win32-x64/bin/quick-lint-js.exe").String():                        MicrosoftOsslsigncode,
+	NewDeepPath2("vscode/quick-lint-js-2.3.0.vsix", "extension/dist/quick-lint-js-vscode-node_darwin-arm64.node").String(): AppleCodesign,
+	NewDeepPath2("vscode/quick-lint-js-2.3.0.vsix", "extension/dist/quick-lint-js-vscode-node_darwin-x64.node").String():   AppleCodesign,
+	NewDeepPath2("vscode/quick-lint-js-2.3.0.vsix", "extension/dist/quick-lint-js-vscode-node_linux-arm.node").String():    GPGSign,
+	NewDeepPath2("vscode/quick-lint-js-2.3.0.vsix", "extension/dist/quick-lint-js-vscode-node_linux-arm64.node").String():  GPGSign,
+	NewDeepPath2("vscode/quick-lint-js-2.3.0.vsix", "extension/dist/quick-lint-js-vscode-node_linux-x64.node").String():    GPGSign,
+	NewDeepPath2("vscode/quick-lint-js-2.3.0.vsix", "extension/dist/quick-lint-js-vscode-node_win32-arm.node").String():    MicrosoftOsslsigncode,
+	NewDeepPath2("vscode/quick-lint-js-2.3.0.vsix", "extension/dist/quick-lint-js-vscode-node_win32-arm64.node").String():  MicrosoftOsslsigncode,
+	NewDeepPath2("vscode/quick-lint-js-2.3.0.vsix", "extension/dist/quick-lint-js-vscode-node_win32-ia32.node").String():   MicrosoftOsslsigncode,
+	NewDeepPath2("vscode/quick-lint-js-2.3.0.vsix", "extension/dist/quick-lint-js-vscode-node_win32-x64.node").String():    MicrosoftOsslsigncode,
 }
 
 func CheckUnsignedFiles() error {
+	filesToTransformMu.Lock()
+	defer filesToTransformMu.Unlock()
 	foundError := false
-	for deepPath, _ := range filesToTransform {
-		log.Printf("file should have been signed but wasn't: %v", deepPath)
+	for path := range filesToTransform {
+		log.Printf("file should have been signed but wasn't: %v", path)
 		foundError = true
 	}
 	if foundError {
@@ -192,6 +379,178 @@ func CheckUnsignedFiles() error {
 	return nil
 }
 
+// SHA256Hash is the digest type returned by sha256.Sum256, named so it can
+// be used as a map key and passed around without repeating [32]byte
+// everywhere.
+type SHA256Hash [32]byte
+
+// DeepHasher computes the SHA-256 of every regular file under a directory,
+// keyed by its path relative to that directory, AND of every member nested
+// inside a .tar.gz/.tgz, .zip/.nupkg/.vsix, or .deb it finds along the way
+// (keyed by DeepPath.String(), the same "!"-joined form filesToTransform and
+// ProvenanceFileRecord use), recursing into members that are themselves one
+// of those archive formats. Unlike ListOfHashes (which produces a
+// shasum(1)-style listing for publishing), DeepHasher exists to compare two
+// directory trees (or a tree against recorded provenance) against each
+// other down to the files that actually got signed.
+type DeepHasher struct {
+	Hashes map[string]SHA256Hash
+}
+
+func NewDeepHasher() DeepHasher {
+	return DeepHasher{Hashes: make(map[string]SHA256Hash)}
+}
+
+func (self *DeepHasher) DeepHashDirectory(dir string) error {
+	return filepath.Walk(dir, func(path string, info fs.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		relativePath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		self.Hashes[relativePath] = sha256.Sum256(content)
+		return self.deepHashArchiveMembers(NewDeepPath(relativePath), content)
+	})
+}
+
+// archiveMember is one entry read back out of a .tar.gz, .zip, or .deb by
+// deepHashArchiveMembers; it mirrors the handful of fields TransformTarGz/
+// TransformZip/TransformDeb need from their own archive readers, but this
+// one never signs anything -- it only reads archives back to hash what's
+// already on disk.
+type archiveMember struct {
+	name    string
+	content []byte
+}
+
+// archiveMembersOf lists name's direct archive members, or returns ok=false
+// if name doesn't look like a format DeepHasher knows how to open. It uses
+// the PathLooksLike* predicates, whose suffixes match the .tar.gz, .zip and
+// .deb formats registered for TransformFile's archive dispatch (see
+// archive_format.go); .rpm packages are not opened.
+func archiveMembersOf(name string, content []byte) (members []archiveMember, ok bool, err error) {
+	switch {
+	case PathLooksLikeTarGz(name):
+		members, err = tarGzArchiveMembers(content)
+		return members, true, err
+	case PathLooksLikeZip(name):
+		members, err = zipArchiveMembers(content)
+		return members, true, err
+	case PathLooksLikeDeb(name):
+		members, err = debArchiveMembers(content)
+		return members, true, err
+	default:
+		return nil, false, nil
+	}
+}
+
+func tarGzArchiveMembers(content []byte) ([]archiveMember, error) {
+	gzipReader, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	var members []archiveMember
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		memberContent, err := io.ReadAll(tarReader)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, archiveMember{name: header.Name, content: memberContent})
+	}
+	return members, nil
+}
+
+func zipArchiveMembers(content []byte) ([]archiveMember, error) {
+	zipReader, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return nil, err
+	}
+	var members []archiveMember
+	for _, zipFile := range zipReader.File {
+		if zipFile.FileInfo().IsDir() {
+			continue
+		}
+		fileReader, err := zipFile.Open()
+		if err != nil {
+			return nil, err
+		}
+		memberContent, err := io.ReadAll(fileReader)
+		fileReader.Close()
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, archiveMember{name: zipFile.Name, content: memberContent})
+	}
+	return members, nil
+}
+
+func debArchiveMembers(content []byte) ([]archiveMember, error) {
+	var members []archiveMember
+	arReader := ar.NewReader(bytes.NewReader(content))
+	for {
+		header, err := arReader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		memberContent, err := io.ReadAll(arReader)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, archiveMember{name: header.Name, content: memberContent})
+	}
+	return members, nil
+}
+
+// deepHashArchiveMembers adds an entry to self.Hashes for every member
+// nested inside deepPath's content (recursing into members that are
+// themselves archives), or does nothing if deepPath.Last() isn't a format
+// DeepHasher recognizes.
+func (self *DeepHasher) deepHashArchiveMembers(deepPath DeepPath, content []byte) error {
+	members, ok, err := archiveMembersOf(deepPath.Last(), content)
+	if err != nil || !ok {
+		return err
+	}
+	for _, member := range members {
+		memberPath, err := deepPath.Append(member.name)
+		if err != nil {
+			return err
+		}
+		self.Hashes[memberPath.String()] = sha256.Sum256(member.content)
+		if err := self.deepHashArchiveMembers(memberPath, member.content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// signatureSiblingSuffixes lists the detached-signature files a CodeSigner
+// or top-level archive signing step may write next to (rather than inside)
+// the file it signs: GPG's ".asc", the PKCS#11 ELF signer's ".sig", and
+// cosign's ".cosign.bundle". TransformCache already guarantees bit-identical
+// inputs produce bit-identical signed output, so these siblings should be
+// just as idempotent as the primary file they accompany.
+var signatureSiblingSuffixes = []string{".asc", ".sig", ".cosign.bundle"}
+
 // Verify that modified files are modified in an idempotent
 // way.
 //
@@ -200,7 +559,10 @@ func CheckUnsignedFiles() error {
 // and a [possibly signed] b.exe. If a.exe and b.exe in
 // sourceDir have the same content as each other, then
 // CheckDoubleSigning checks that a.exe and b.exe in
-// destinationDir have the same content as each other.
+// destinationDir have the same content as each other. The same check is
+// made for each file's detached-signature siblings (see
+// signatureSiblingSuffixes), since a cosign/PKCS#11/GPG bug could make a
+// signature diverge even when the primary file it accompanies didn't.
 func CheckDoubleSigning(sourceDir string, destinationDir string) error {
 	sourceDirHashes := NewDeepHasher()
 	if err := sourceDirHashes.DeepHashDirectory(sourceDir); err != nil {
@@ -211,9 +573,11 @@ func CheckDoubleSigning(sourceDir string, destinationDir string) error {
 		return err
 	}
 
+	// Keyed by DeepPath.String() rather than DeepPath itself: see DeepPath's
+	// definition for why DeepPath can't be used as a map key.
 	sourceToDestinationHashes := make(map[SHA256Hash]map[SHA256Hash]bool)
-	sourceHashToPaths := make(map[SHA256Hash][]DeepPath)
-	destinationHashToPaths := make(map[SHA256Hash][]DeepPath)
+	sourceHashToPaths := make(map[SHA256Hash][]string)
+	destinationHashToPaths := make(map[SHA256Hash][]string)
 	for path, sourceHash := range sourceDirHashes.Hashes {
 		destinationHash := destinationDirHashes.Hashes[path]
 		if _, exists := sourceToDestinationHashes[sourceHash]; !exists {
@@ -224,8 +588,8 @@ func CheckDoubleSigning(sourceDir string, destinationDir string) error {
 		destinationHashToPaths[destinationHash] = append(destinationHashToPaths[destinationHash], path)
 	}
 
-	prettyPrintBadConversion := func(destinationHashes map[SHA256Hash]bool, destinationHashToPaths map[SHA256Hash][]DeepPath) {
-		var previousPath *DeepPath = nil
+	prettyPrintBadConversion := func(destinationHashes map[SHA256Hash]bool, destinationHashToPaths map[SHA256Hash][]string) {
+		var previousPath *string = nil
 		for destinationHash, _ := range destinationHashes {
 			path := destinationHashToPaths[destinationHash][0]
 			if previousPath != nil {
@@ -245,12 +609,56 @@ func CheckDoubleSigning(sourceDir string, destinationDir string) error {
 			prettyPrintBadConversion(destinationHashes, destinationHashToPaths)
 		}
 	}
+
+	for _, suffix := range signatureSiblingSuffixes {
+		for _, paths := range sourceHashToPaths {
+			siblingHashes := make(map[SHA256Hash]bool)
+			siblingHashToPaths := make(map[SHA256Hash][]string)
+			for _, path := range paths {
+				siblingPath := path + suffix
+				siblingHash, exists := destinationDirHashes.Hashes[siblingPath]
+				if !exists {
+					continue
+				}
+				siblingHashes[siblingHash] = true
+				siblingHashToPaths[siblingHash] = append(siblingHashToPaths[siblingHash], siblingPath)
+			}
+			if len(siblingHashes) > 1 {
+				detectedBug = true
+				prettyPrintBadConversion(siblingHashes, siblingHashToPaths)
+			}
+		}
+	}
+
 	if detectedBug {
 		return fmt.Errorf("bug detected in sign-release.go")
 	}
 	return nil
 }
 
+// canResumeSkip reports whether -resume may skip re-signing destinationPath:
+// only top-level archives carry their own GPG signature, so only they can be
+// independently re-verified without redoing the (possibly very slow)
+// PKCS#12/HSM signing of everything nested inside. A ".new" sibling means a
+// previous run was killed mid-writeFileAtomic, so destinationPath itself
+// can't be trusted even if it exists.
+func canResumeSkip(destinationPath string, relativePath string) bool {
+	if !PathLooksLikeTarGz(relativePath) && !PathLooksLikeZip(relativePath) {
+		return false
+	}
+	if _, err := os.Stat(destinationPath + ".new"); !errors.Is(err, fs.ErrNotExist) {
+		return false
+	}
+	sigPath := destinationPath + ".asc"
+	if _, err := os.Stat(sigPath); err != nil {
+		return false
+	}
+	if err := gpgSigner.VerifyDetachedSignature(destinationPath, sigPath); err != nil {
+		return false
+	}
+	return true
+}
+
 // If the file is an archive and has a file which needs to be signed, sign the
 // embedded file and recreate the archive. Otherwise, copy the file verbatim.
 func CopyFileOrTransformArchive(deepPath DeepPath, sourcePath string, destinationPath string, sourceInfo fs.FileInfo) error {
@@ -264,38 +672,26 @@ func CopyFileOrTransformArchive(deepPath DeepPath, sourcePath string, destinatio
 	}
 	defer sourceFile.Close()
 
-	destinationFile, err := os.OpenFile(destinationPath,
-		os.O_WRONLY|os.O_CREATE|os.O_TRUNC, sourceInfo.Mode().Perm())
+	transformResult, err := TransformFile(deepPath, sourceFile)
 	if err != nil {
 		return err
 	}
-	fileComplete := false
-	defer (func() {
-		destinationFile.Close()
-		if !fileComplete {
-			os.Remove(destinationPath)
-		}
-	})()
 
-	transformResult, err := TransformFile(deepPath, sourceFile)
+	err = writeFileAtomic(destinationPath, sourceInfo.Mode().Perm(), func(destinationFile io.Writer) error {
+		if transformResult.newFile == nil {
+			_, err := io.Copy(destinationFile, sourceFile)
+			return err
+		}
+		_, err := destinationFile.Write(*transformResult.newFile)
+		return err
+	})
 	if err != nil {
 		return err
 	}
 	if transformResult.newFile == nil {
-		_, err = io.Copy(destinationFile, sourceFile)
-		if err != nil {
+		if err := os.Chtimes(destinationPath, sourceInfo.ModTime(), sourceInfo.ModTime()); err != nil {
 			return err
 		}
-		err = os.Chtimes(destinationPath, sourceInfo.ModTime(), sourceInfo.ModTime())
-		if err != nil {
-			return err
-		}
-		fileComplete = true
-	} else {
-		if _, err := destinationFile.Write(*transformResult.newFile); err != nil {
-			return err
-		}
-		fileComplete = true
 	}
 	if transformResult.siblingFile != nil {
 		panic("siblingFile not yet implemented for filesystem destinations")
@@ -336,47 +732,96 @@ func (self *FileTransformResult) UpdateZipHeader(header *zip.FileHeader) {
 	}
 }
 
-func TransformFile(deepPath DeepPath, file io.Reader) (FileTransformResult, error) {
-	var err error
+// signArchiveContainer wraps transform -- a gpg/rpmsign re-signing of an
+// entire container file, e.g. TransformDeb or TransformRpm -- with the same
+// dedup, singleflight, and provenance recording that TransformFile applies
+// to filesToTransform entries. TransformDeb/TransformRpm can't go through
+// TransformFile's switch directly: they are ArchiveHandlers (TransformDeb
+// also recurses into the container's own entries), and archiveHandlerForPath
+// is consulted before that switch.
+//
+// Unlike TransformFile, signArchiveContainer does not itself acquire
+// signingSemaphore around transform: transform recurses into the
+// container's own entries (e.g. TransformDeb signing the binaries inside
+// control.tar.gz/data.tar.gz), which calls back into TransformFile or
+// signArchiveContainer on the same goroutine, so holding the semaphore here
+// would deadlock against that nested acquire once the pool is saturated.
+// GPGSignFile and RpmSignFile -- the actual external subprocesses transform
+// invokes -- acquire it themselves, right around the process they run.
+func signArchiveContainer(deepPath DeepPath, sourceContent []byte, transformType FileTransformType, transform func([]byte) (FileTransformResult, error)) (FileTransformResult, error) {
+	hasher := sha256.New()
+	hasher.Write(sourceContent)
+	var fileHash SHA256Hash
+	copy(fileHash[:], hasher.Sum(nil))
 
-	if PathLooksLikeTarGz(deepPath.Last()) {
-		// TODO(strager): Optimization: Don't
-		// process this file if no entry of
-		// filesToTransform mentions it.
-		needsTransform := true
-		if needsTransform {
-			transformResult, err := TransformTarGz(deepPath, file)
-			if err != nil {
-				return FileTransformResult{}, err
-			}
-			return transformResult, nil
+	if cached, ok := TransformCache.Load(fileHash); ok {
+		return cached.(FileTransformResult), nil
+	}
+
+	call := &inFlightTransform{done: make(chan struct{})}
+	if actual, loaded := inFlightTransforms.LoadOrStore(fileHash, call); loaded {
+		call = actual.(*inFlightTransform)
+		<-call.done
+		if call.err != nil {
+			return FileTransformResult{}, call.err
 		}
+		return call.result, nil
 	}
+	defer func() {
+		inFlightTransforms.Delete(fileHash)
+		close(call.done)
+	}()
 
-	if PathLooksLikeZip(deepPath.Last()) {
-		// TODO(strager): Optimization: Don't
-		// process this file if no entry of
-		// filesToTransform mentions it.
-		needsTransform := true
-		if needsTransform {
-			fileContent, err := io.ReadAll(file)
-			if err != nil {
-				return FileTransformResult{}, err
-			}
+	transformResult, err := transform(sourceContent)
+	if err != nil {
+		call.err = err
+		return FileTransformResult{}, err
+	}
+	call.result = transformResult
+	TransformCache.Store(fileHash, transformResult)
+	// TransformCache and the singleflight dedup above key on fileHash (the
+	// unsigned input), but provenance records the output: what VerifyProvenance
+	// re-hashes from destinationDir is the signed content, so the record has
+	// to match that, not the input it was signed from.
+	RecordProvenance(deepPath, sha256.Sum256(primaryContentOf(sourceContent, transformResult)), transformType)
+	return transformResult, nil
+}
 
-			transformResult, err := TransformZip(deepPath, fileContent)
-			if err != nil {
-				return FileTransformResult{}, err
-			}
-			return transformResult, nil
+// primaryContentOf returns what deepPath's file actually holds after result:
+// result.newFile if the transform replaced the file's content (as
+// AppleCodesign/AutoCodeSign/MicrosoftOsslsigncode/DebSign/RpmSign do), or
+// original unchanged if it only added a detached-signature sibling (as
+// GPGSign and CosignSign do).
+func primaryContentOf(original []byte, result FileTransformResult) []byte {
+	if result.newFile != nil {
+		return *result.newFile
+	}
+	return original
+}
+
+func TransformFile(deepPath DeepPath, file io.Reader) (FileTransformResult, error) {
+	var err error
+
+	// TODO(strager): Optimization: Don't recurse into this archive if no
+	// entry of filesToTransform mentions it.
+	if handler, ok := archiveHandlerForPath(deepPath.Last()); ok {
+		transformResult, err := handler(deepPath, file)
+		if err != nil {
+			return FileTransformResult{}, err
 		}
+		return transformResult, nil
 	}
 
-	transformType := filesToTransform[deepPath]
+	filesToTransformMu.Lock()
+	transformType := filesToTransform[deepPath.String()]
+	filesToTransformMu.Unlock()
 
 	var fileHash SHA256Hash
+	var fileContent []byte
+	var inFlight *inFlightTransform
 	if transformType != NoTransform {
-		fileContent, err := io.ReadAll(file)
+		var err error
+		fileContent, err = io.ReadAll(file)
 		if err != nil {
 			return FileTransformResult{}, err
 		}
@@ -388,21 +833,70 @@ func TransformFile(deepPath DeepPath, file io.Reader) (FileTransformResult, erro
 		hashSlice := hasher.Sum(nil)
 		copy(fileHash[:], hashSlice)
 
-		cachedTransform := TransformCache[fileHash]
-		if cachedTransform.newFile != nil || cachedTransform.siblingFile != nil {
-			delete(filesToTransform, deepPath)
-			return cachedTransform, nil
+		if cached, ok := TransformCache.Load(fileHash); ok {
+			markFileTransformed(deepPath)
+			return cached.(FileTransformResult), nil
+		}
+
+		// Singleflight: if another goroutine is already transforming a file
+		// with this exact content (e.g. the same quick-lint-js.exe in two
+		// different zips), wait for it instead of spawning a second
+		// codesign/gpg/osslsigncode process.
+		call := &inFlightTransform{done: make(chan struct{})}
+		if actual, loaded := inFlightTransforms.LoadOrStore(fileHash, call); loaded {
+			call = actual.(*inFlightTransform)
+			<-call.done
+			if call.err != nil {
+				return FileTransformResult{}, call.err
+			}
+			markFileTransformed(deepPath)
+			return call.result, nil
 		}
+		inFlight = call
+		defer func() {
+			inFlightTransforms.Delete(fileHash)
+			close(call.done)
+		}()
 
 		file = bytes.NewReader(fileContent)
 	}
 
+	// Actual signing invokes an external process (codesign, gpg,
+	// osslsigncode); bound how many run concurrently.
+	if transformType != NoTransform {
+		signingSemaphore <- struct{}{}
+		defer func() { <-signingSemaphore }()
+	}
+
 	var transform FileTransformResult
 	switch transformType {
 	case AppleCodesign:
 		log.Printf("signing with Apple codesign: %v\n", deepPath)
 		transform, err = AppleCodesignTransform(deepPath.Last(), file)
 		if err != nil {
+			if inFlight != nil {
+				inFlight.err = err
+			}
+			return FileTransformResult{}, err
+		}
+
+	case AutoCodeSign:
+		log.Printf("signing with auto-detected code signer: %v\n", deepPath)
+		transform, err = AutoCodeSignTransform(deepPath.Last(), file)
+		if err != nil {
+			if inFlight != nil {
+				inFlight.err = err
+			}
+			return FileTransformResult{}, err
+		}
+
+	case CosignSign:
+		log.Printf("signing with cosign: %v\n", deepPath)
+		transform, err = CosignTransform(deepPath.Last(), file)
+		if err != nil {
+			if inFlight != nil {
+				inFlight.err = err
+			}
 			return FileTransformResult{}, err
 		}
 
@@ -410,6 +904,9 @@ func TransformFile(deepPath DeepPath, file io.Reader) (FileTransformResult, erro
 		log.Printf("signing with GPG: %v\n", deepPath)
 		transform, err = GPGSignTransform(deepPath.Last(), file)
 		if err != nil {
+			if inFlight != nil {
+				inFlight.err = err
+			}
 			return FileTransformResult{}, err
 		}
 
@@ -417,6 +914,9 @@ func TransformFile(deepPath DeepPath, file io.Reader) (FileTransformResult, erro
 		log.Printf("signing with osslsigncode: %v\n", deepPath)
 		transform, err = MicrosoftOsslsigncodeTransform(file)
 		if err != nil {
+			if inFlight != nil {
+				inFlight.err = err
+			}
 			return FileTransformResult{}, err
 		}
 
@@ -424,11 +924,41 @@ func TransformFile(deepPath DeepPath, file io.Reader) (FileTransformResult, erro
 		return NoOpTransform(), nil
 	}
 
-	delete(filesToTransform, deepPath)
-	TransformCache[fileHash] = transform
+	markFileTransformed(deepPath)
+	TransformCache.Store(fileHash, transform)
+	if inFlight != nil {
+		inFlight.result = transform
+	}
+	// See signArchiveContainer's identical call for why this hashes the
+	// transform's output rather than reusing fileHash (the unsigned input).
+	RecordProvenance(deepPath, sha256.Sum256(primaryContentOf(fileContent, transform)), transformType)
 	return transform, nil
 }
 
+func markFileTransformed(deepPath DeepPath) {
+	filesToTransformMu.Lock()
+	defer filesToTransformMu.Unlock()
+	delete(filesToTransform, deepPath.String())
+}
+
+// markArchiveResumedAsTransformed deletes every filesToTransform entry
+// nested inside relativePath. canResumeSkip only lets -resume skip
+// re-signing a whole top-level archive whose GPG signature already
+// verifies, which means CopyFileOrTransformArchive (and therefore
+// markFileTransformed) never runs for anything nested inside it; without
+// this, CheckUnsignedFiles would wrongly report those entries as never
+// signed.
+func markArchiveResumedAsTransformed(relativePath string) {
+	prefix := relativePath + "!"
+	filesToTransformMu.Lock()
+	defer filesToTransformMu.Unlock()
+	for key := range filesToTransform {
+		if key == relativePath || strings.HasPrefix(key, prefix) {
+			delete(filesToTransform, key)
+		}
+	}
+}
+
 func TransformTarGz(
 	tarGzDeepPath DeepPath,
 	sourceFile io.Reader,
@@ -457,6 +987,13 @@ func TransformTarGzToFile(
 	tarReader := tar.NewReader(sourceUngzippedFile)
 	tarWriter := tar.NewWriter(destinationUngzippedFile)
 	defer tarWriter.Close()
+
+	type tarEntry struct {
+		header          *tar.Header
+		fileContent     []byte
+		transformResult FileTransformResult
+	}
+	var entries []*tarEntry
 	for {
 		header, err := tarReader.Next()
 		if errors.Is(err, io.EOF) {
@@ -474,13 +1011,37 @@ func TransformTarGzToFile(
 			return fmt.Errorf("failed to read entire file")
 		}
 
-		transformResult, err := TransformFile(tarGzDeepPath.Append(header.Name), bytes.NewReader(fileContent))
-		if err != nil {
-			return err
-		}
+		entries = append(entries, &tarEntry{header: header, fileContent: fileContent})
+	}
+
+	// Transform every entry concurrently (bounded by signingSemaphore), then
+	// reassemble the tarball sequentially below so output order matches the
+	// source archive.
+	group, _ := errgroup.WithContext(context.Background())
+	for _, entry := range entries {
+		entry := entry
+		group.Go(func() error {
+			entryDeepPath, err := tarGzDeepPath.Append(entry.header.Name)
+			if err != nil {
+				return err
+			}
+			transformResult, err := TransformFile(entryDeepPath, bytes.NewReader(entry.fileContent))
+			if err != nil {
+				return err
+			}
+			entry.transformResult = transformResult
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return err
+	}
 
+	for _, entry := range entries {
+		header := entry.header
+		transformResult := entry.transformResult
 		transformResult.UpdateTarHeader(header)
-		var newFileContent []byte = fileContent
+		newFileContent := entry.fileContent
 		if transformResult.newFile != nil {
 			newFileContent = *transformResult.newFile
 		}
@@ -536,18 +1097,35 @@ func TransformZipToFile(
 	destinationZipFile := zip.NewWriter(destinationFile)
 	defer destinationZipFile.Close()
 
-	for _, zipEntry := range sourceZipFile.File {
-		zipEntryFile, err := zipEntry.Open()
-		if err != nil {
-			return err
-		}
-		defer zipEntryFile.Close()
+	transformResults := make([]FileTransformResult, len(sourceZipFile.File))
+	group, _ := errgroup.WithContext(context.Background())
+	for i, zipEntry := range sourceZipFile.File {
+		i, zipEntry := i, zipEntry
+		group.Go(func() error {
+			zipEntryFile, err := zipEntry.Open()
+			if err != nil {
+				return err
+			}
+			defer zipEntryFile.Close()
 
-		transformResult, err := TransformFile(zipDeepPath.Append(zipEntry.Name), zipEntryFile)
-		if err != nil {
-			return err
-		}
+			entryDeepPath, err := zipDeepPath.Append(zipEntry.Name)
+			if err != nil {
+				return err
+			}
+			transformResult, err := TransformFile(entryDeepPath, zipEntryFile)
+			if err != nil {
+				return err
+			}
+			transformResults[i] = transformResult
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return err
+	}
 
+	for i, zipEntry := range sourceZipFile.File {
+		transformResult := transformResults[i]
 		transformResult.UpdateZipHeader(&zipEntry.FileHeader)
 		if transformResult.newFile == nil {
 			rawZIPEntryFile, err := zipEntry.OpenRaw()
@@ -598,7 +1176,7 @@ func AppleCodesignTransform(originalPath string, exe io.Reader) (FileTransformRe
 	if err != nil {
 		return FileTransformResult{}, err
 	}
-	TempDirs = append(TempDirs, tempDir)
+	addTempDir(tempDir)
 
 	// Name the file the same as the original. The codesign utility
 	// sometimes uses the file name as the Identifier, and we don't want the
@@ -668,7 +1246,7 @@ func GPGSignTransform(originalPath string, exe io.Reader) (FileTransformResult,
 	if err != nil {
 		return FileTransformResult{}, err
 	}
-	TempDirs = append(TempDirs, tempDir)
+	addTempDir(tempDir)
 
 	tempFile, err := os.Create(filepath.Join(tempDir, "data"))
 	if err != nil {
@@ -681,86 +1259,160 @@ func GPGSignTransform(originalPath string, exe io.Reader) (FileTransformResult,
 		return FileTransformResult{}, err
 	}
 
-	signatureFilePath, err := GPGSignFile(tempFile.Name())
+	signatureFileContent, err := gpgSigner.SignFileDetached(tempFile.Name())
 	if err != nil {
 		return FileTransformResult{}, err
 	}
-	if err := GPGVerifySignature(tempFile.Name(), signatureFilePath); err != nil {
+	if err := gpgSigner.VerifyDetachedSignature(tempFile.Name(), tempFile.Name()+".asc"); err != nil {
 		return FileTransformResult{}, err
 	}
 
-	signatureFileContent, err := os.ReadFile(signatureFilePath)
-	if err != nil {
-		return FileTransformResult{}, err
-	}
 	return FileTransformResult{
 		siblingFile:     &signatureFileContent,
 		siblingFileName: filepath.Base(originalPath) + ".asc",
 	}, nil
 }
 
+// GPGSignFile signs filePath with gpgSigner and returns the path to the
+// detached signature, kept around because main signs top-level artifacts
+// (SHA256SUMS, the source tarball, each packaged archive) this way rather
+// than through a FileTransformResult sibling. Acquires signingSemaphore
+// itself around the actual gpg subprocess, since some callers (e.g.
+// signArchiveContainer via DebSignOrigin) run on a goroutine that may
+// already be recursing through a nested signing call.
 func GPGSignFile(filePath string) (string, error) {
-	process := exec.Command(
-		"gpg",
-		"--local-user", signingStuff.GPGIdentity,
-		"--armor",
-		"--detach-sign",
-		"--",
-		filePath,
-	)
-	process.Stdout = os.Stdout
-	process.Stderr = os.Stderr
-	if err := process.Start(); err != nil {
-		return "", err
-	}
-	if err := process.Wait(); err != nil {
+	signingSemaphore <- struct{}{}
+	defer func() { <-signingSemaphore }()
+
+	if _, err := gpgSigner.SignFileDetached(filePath); err != nil {
 		return "", err
 	}
 	return filePath + ".asc", nil
 }
 
-func GPGVerifySignature(filePath string, signatureFilePath string) error {
-	// HACK(strager): Use /tmp instead of the default temp dir. macOS'
-	// default temp dir is so long that it breaks gpg-agent.
-	tempGPGHome, err := ioutil.TempDir("/tmp", "quick-lint-js-sign-release")
+// runVerifyCommand implements "qljs-sign verify <artifact>...": unlike the
+// rest of main, it never sets signingStuff.Certificate or
+// signingStuff.GPGKey, so GPGVerifySignature/MicrosoftOsslsigncodeVerifyFile
+// fall back to the certificate and key embedded in the trustbundle package.
+// That's what lets verification work offline, from just this binary, with
+// no other flags or side-channel certificate distribution.
+func runVerifyCommand(artifactPaths []string) {
+	if len(artifactPaths) == 0 {
+		os.Stderr.WriteString("usage: qljs-sign verify <artifact>...\n")
+		os.Exit(2)
+	}
+
+	anyFailed := false
+	for _, artifactPath := range artifactPaths {
+		if err := VerifyArtifactSignature(artifactPath); err != nil {
+			log.Printf("%s: FAILED: %v", artifactPath, err)
+			anyFailed = true
+		} else {
+			log.Printf("%s: OK", artifactPath)
+		}
+	}
+	if anyFailed {
+		os.Exit(1)
+	}
+}
+
+// VerifyArtifactSignature checks artifactPath's signature: a detached GPG
+// ".asc" sibling for archives (tarballs, zips, nupkgs), or the embedded
+// Authenticode signature for PE binaries. It only consults the trustbundle
+// fallback (see runVerifyCommand), never a locally-configured signing
+// identity.
+func VerifyArtifactSignature(artifactPath string) error {
+	content, err := os.ReadFile(artifactPath)
 	if err != nil {
 		return err
 	}
-	TempDirs = append(TempDirs, tempGPGHome)
 
-	var env []string
-	env = append([]string{}, os.Environ()...)
-	env = append(env, "GNUPGHOME="+tempGPGHome)
+	if looksLikePE(content) {
+		return MicrosoftOsslsigncodeVerifyFile(artifactPath)
+	}
 
-	process := exec.Command("gpg", "--import")
-	keyReader := bytes.NewReader(signingStuff.GPGKey)
-	process.Stdin = keyReader
-	process.Stdout = os.Stdout
-	process.Stderr = os.Stderr
-	process.Env = env
-	if err := process.Start(); err != nil {
-		return err
+	signatureFilePath := artifactPath + ".asc"
+	if _, err := os.Stat(signatureFilePath); err != nil {
+		return fmt.Errorf("no known signature found (expected a detached %q)", signatureFilePath)
 	}
-	if err := process.Wait(); err != nil {
-		return err
+	return GPGVerifySignature(artifactPath, signatureFilePath)
+}
+
+// GPGVerifySignature checks signatureFilePath against filePath using
+// signingStuff.GPGKey if main set one, and otherwise falls back to the key
+// embedded in the trustbundle package, so verification works from just this
+// binary (e.g. `qljs-sign verify <artifact>`) without the caller having to
+// pass -PrivateKeyPKCS12's GPG key alongside it. Built as a standalone
+// GPGSigner rather than read off gpgSigner, which is nil in the
+// "qljs-sign verify" path (Identity isn't needed for verification, so it's
+// left unset).
+func GPGVerifySignature(filePath string, signatureFilePath string) error {
+	key := signingStuff.GPGKey
+	if len(key) == 0 {
+		key = trustbundle.GPGKey
+	}
+	verifier := &GPGSigner{
+		Key:          key,
+		UseInProcess: useInProcessGPG,
 	}
+	return verifier.VerifyDetachedSignature(filePath, signatureFilePath)
+}
 
-	process = exec.Command(
-		"gpg", "--verify",
-		"--",
-		signatureFilePath,
-		filePath,
-	)
+// originalPath need not be a path to a real file.
+//
+// Produces a "<name>.cosign.bundle" sibling file containing the detached
+// signature and certificate, in the JSON format cosign's --bundle flag
+// writes (so `cosign verify-blob --bundle ... --certificate-identity ...`
+// can check it without a separate Rekor lookup).
+func CosignTransform(originalPath string, blob io.Reader) (FileTransformResult, error) {
+	tempDir, err := ioutil.TempDir("", "quick-lint-js-sign-release")
+	if err != nil {
+		return FileTransformResult{}, err
+	}
+	addTempDir(tempDir)
+
+	tempFile, err := os.Create(filepath.Join(tempDir, "data"))
+	if err != nil {
+		return FileTransformResult{}, err
+	}
+	defer os.Remove(tempFile.Name())
+	_, err = io.Copy(tempFile, blob)
+	tempFile.Close()
+	if err != nil {
+		return FileTransformResult{}, err
+	}
+
+	bundlePath := tempFile.Name() + ".cosign.bundle"
+	if err := CosignSignBlob(tempFile.Name(), bundlePath); err != nil {
+		return FileTransformResult{}, err
+	}
+
+	bundleContent, err := os.ReadFile(bundlePath)
+	if err != nil {
+		return FileTransformResult{}, err
+	}
+	return FileTransformResult{
+		siblingFile:     &bundleContent,
+		siblingFileName: filepath.Base(originalPath) + ".cosign.bundle",
+	}, nil
+}
+
+func CosignSignBlob(inFilePath string, bundlePath string) error {
+	signCommand := []string{"cosign", "sign-blob", "--yes", "--bundle", bundlePath}
+	if signingStuff.CosignKey != "" {
+		signCommand = append(signCommand, "--key", signingStuff.CosignKey)
+	}
+	signCommand = append(signCommand, "--", inFilePath)
+
+	process := exec.Command(signCommand[0], signCommand[1:]...)
 	process.Stdout = os.Stdout
 	process.Stderr = os.Stderr
-	process.Env = env
 	if err := process.Start(); err != nil {
 		return err
 	}
 	if err := process.Wait(); err != nil {
 		return err
 	}
-
 	return nil
 }
 
@@ -769,7 +1421,7 @@ func MicrosoftOsslsigncodeTransform(exe io.Reader) (FileTransformResult, error)
 	if err != nil {
 		return FileTransformResult{}, err
 	}
-	TempDirs = append(TempDirs, tempDir)
+	addTempDir(tempDir)
 
 	unsignedFile, err := os.Create(filepath.Join(tempDir, "unsigned.exe"))
 	if err != nil {
@@ -800,26 +1452,49 @@ func MicrosoftOsslsigncodeTransform(exe io.Reader) (FileTransformResult, error)
 }
 
 func MicrosoftOsslsigncodeFile(inFilePath string, outFilePath string) error {
+	if !useOsslsigncode {
+		return authenticode.Sign(inFilePath, outFilePath, authenticode.Options{
+			PrivateKeyPKCS12Path: signingStuff.PrivateKeyPKCS12Path,
+			TimestampURL:         authenticodeTimestampURL,
+		})
+	}
+
+	// osslsigncode truncates -out in place as it writes, so a killed process
+	// would leave a half-signed outFilePath; sign into a ".new" sibling and
+	// rename it over outFilePath only once osslsigncode exits successfully.
+	tempOutFilePath := outFilePath + ".new"
 	signCommand := []string{
 		"osslsigncode", "sign",
 		"-pkcs12", signingStuff.PrivateKeyPKCS12Path,
-		"-t", "http://timestamp.digicert.com",
+		"-t", authenticodeTimestampURL,
 		"-in", inFilePath,
-		"-out", outFilePath,
+		"-out", tempOutFilePath,
 	}
 	process := exec.Command(signCommand[0], signCommand[1:]...)
 	process.Stdout = os.Stdout
 	process.Stderr = os.Stderr
 	if err := process.Start(); err != nil {
+		os.Remove(tempOutFilePath)
 		return err
 	}
 	if err := process.Wait(); err != nil {
+		os.Remove(tempOutFilePath)
 		return err
 	}
-	return nil
+	return os.Rename(tempOutFilePath, outFilePath)
 }
 
+// MicrosoftOsslsigncodeVerifyFile checks filePath against
+// signingStuff.Certificate if main set one, and otherwise falls back to the
+// certificate embedded in the trustbundle package, so verification works
+// from just this binary (e.g. `qljs-sign verify <artifact>`) without the
+// caller having to pass -PrivateKeyPKCS12's certificate alongside it.
 func MicrosoftOsslsigncodeVerifyFile(filePath string) error {
+	certificate := signingStuff.Certificate
+	if len(certificate) == 0 {
+		certificate = trustbundle.AppleCodesignCertificate
+	}
+
 	certificatePEMFile, err := ioutil.TempFile("", "quick-lint-js-sign-release")
 	if err != nil {
 		return err
@@ -833,7 +1508,7 @@ func MicrosoftOsslsigncodeVerifyFile(filePath string) error {
 		"-outform", "pem",
 		"-out", certificatePEMFile.Name(),
 	)
-	certificateReader := bytes.NewReader(signingStuff.Certificate)
+	certificateReader := bytes.NewReader(certificate)
 	process.Stdin = certificateReader
 	process.Stdout = os.Stdout
 	process.Stderr = os.Stderr
@@ -875,8 +1550,62 @@ func WriteTarEntry(header *tar.Header, fileContent []byte, output *tar.Writer) e
 	return nil
 }
 
+// HashAlgo is a digest algorithm ListOfHashes can compute and
+// VerifyChecksumFile can check releases against.
+type HashAlgo int
+
+const (
+	SHA256 HashAlgo = iota
+	SHA512
+	BLAKE2b_256
+)
+
+// sumsFileName is the shasum(1)-style checksum file algo's hashes are
+// dumped into: SHA256SUMS and SHA512SUMS follow the convention shasum
+// itself uses; BLAKE2B256SUMS is our own name, for downstreams (Debian
+// repro-builds, PyPI's new hash set) that verify BLAKE2b instead.
+func (algo HashAlgo) sumsFileName() string {
+	switch algo {
+	case SHA256:
+		return "SHA256SUMS"
+	case SHA512:
+		return "SHA512SUMS"
+	case BLAKE2b_256:
+		return "BLAKE2B256SUMS"
+	default:
+		panic(fmt.Sprintf("unknown HashAlgo %d", algo))
+	}
+}
+
+func (algo HashAlgo) newHasher() (hash.Hash, error) {
+	switch algo {
+	case SHA256:
+		return sha256.New(), nil
+	case SHA512:
+		return sha512.New(), nil
+	case BLAKE2b_256:
+		return blake2b.New256(nil)
+	default:
+		return nil, fmt.Errorf("unknown HashAlgo %d", algo)
+	}
+}
+
+// ListOfHashes accumulates one shasum(1)-style listing ("<hex digest>  <name>\n"
+// per file) for each configured HashAlgo. AddHashOfFile streams each file
+// through every configured hasher at once via io.MultiWriter, so adding
+// more algorithms doesn't mean re-reading every release artifact once per
+// algorithm.
 type ListOfHashes struct {
-	SHA256Hashes bytes.Buffer
+	Algos  []HashAlgo
+	hashes map[HashAlgo]*bytes.Buffer
+}
+
+func NewListOfHashes(algos ...HashAlgo) ListOfHashes {
+	hashes := make(map[HashAlgo]*bytes.Buffer, len(algos))
+	for _, algo := range algos {
+		hashes[algo] = &bytes.Buffer{}
+	}
+	return ListOfHashes{Algos: algos, hashes: hashes}
 }
 
 func (self *ListOfHashes) AddHashOfFile(path string, name string) error {
@@ -885,36 +1614,63 @@ func (self *ListOfHashes) AddHashOfFile(path string, name string) error {
 		return err
 	}
 	defer file.Close()
-	hasher := sha256.New()
-	if _, err := io.Copy(hasher, file); err != nil {
-		return err
+
+	hashers := make(map[HashAlgo]hash.Hash, len(self.Algos))
+	writers := make([]io.Writer, 0, len(self.Algos))
+	for _, algo := range self.Algos {
+		hasher, err := algo.newHasher()
+		if err != nil {
+			return err
+		}
+		hashers[algo] = hasher
+		writers = append(writers, hasher)
 	}
-	self.SHA256Hashes.WriteString(fmt.Sprintf("%x", hasher.Sum(nil)))
-	self.SHA256Hashes.WriteString("  ")
-	self.SHA256Hashes.WriteString(name)
-	self.SHA256Hashes.WriteString("\n")
-	return nil
-}
 
-func (self *ListOfHashes) DumpSHA256HashesToFile(outPath string) error {
-	outFile, err := os.Create(outPath)
-	if err != nil {
+	if _, err := io.Copy(io.MultiWriter(writers...), file); err != nil {
 		return err
 	}
-	defer outFile.Close()
-	data := self.SHA256Hashes.Bytes()
-	bytesWritten, err := outFile.Write(data)
-	if err != nil {
-		return err
+
+	for _, algo := range self.Algos {
+		fmt.Fprintf(self.hashes[algo], "%x  %s\n", hashers[algo].Sum(nil), name)
 	}
-	if bytesWritten != len(data) {
-		return fmt.Errorf("failed to write entire file")
+	return nil
+}
+
+// DumpChecksumFiles writes one shasum(1)-style listing per configured
+// HashAlgo into dir, named per HashAlgo.sumsFileName (SHA256SUMS,
+// SHA512SUMS, BLAKE2B256SUMS).
+func (self *ListOfHashes) DumpChecksumFiles(dir string) error {
+	for _, algo := range self.Algos {
+		outPath := filepath.Join(dir, algo.sumsFileName())
+		data := self.hashes[algo].Bytes()
+		err := writeFileAtomic(outPath, 0644, func(w io.Writer) error {
+			_, err := w.Write(data)
+			return err
+		})
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func VerifySHA256SUMSFile(hashesPath string) error {
-	process := exec.Command("shasum", "--algorithm", "256", "--check", "--", filepath.Base(hashesPath))
+// VerifyChecksumFile checks every file hashesPath lists against a freshly
+// computed digest, dispatching to shasum(1) for algorithms it supports
+// (SHA-256, SHA-512) and to a Go-native verifier for BLAKE2b, which shasum
+// doesn't implement.
+func VerifyChecksumFile(hashesPath string, algo HashAlgo) error {
+	switch algo {
+	case SHA256:
+		return verifyChecksumFileWithShasum(hashesPath, "256")
+	case SHA512:
+		return verifyChecksumFileWithShasum(hashesPath, "512")
+	default:
+		return verifyChecksumFileNatively(hashesPath, algo)
+	}
+}
+
+func verifyChecksumFileWithShasum(hashesPath string, algorithmBits string) error {
+	process := exec.Command("shasum", "--algorithm", algorithmBits, "--check", "--", filepath.Base(hashesPath))
 	process.Stdout = os.Stdout
 	process.Stderr = os.Stderr
 	process.Dir = filepath.Dir(hashesPath)
@@ -927,44 +1683,133 @@ func VerifySHA256SUMSFile(hashesPath string) error {
 	return nil
 }
 
+func verifyChecksumFileNatively(hashesPath string, algo HashAlgo) error {
+	content, err := os.ReadFile(hashesPath)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(hashesPath)
+
+	lines := strings.Split(strings.TrimRight(string(content), "\n"), "\n")
+	for lineNumber, line := range lines {
+		if line == "" {
+			continue
+		}
+		fields := strings.SplitN(line, "  ", 2)
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: malformed checksum line", hashesPath, lineNumber+1)
+		}
+		expectedHash, name := fields[0], fields[1]
+
+		hasher, err := algo.newHasher()
+		if err != nil {
+			return err
+		}
+		file, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(hasher, file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+
+		actualHash := fmt.Sprintf("%x", hasher.Sum(nil))
+		if actualHash != expectedHash {
+			return fmt.Errorf("%s: %s: checksum mismatch", hashesPath, name)
+		}
+		log.Printf("%s: OK\n", name)
+	}
+	return nil
+}
+
+// deepPathInlineCapacity is how many components of a DeepPath are stored
+// inline before it spills into a heap-allocated overflow slice. Most paths
+// (a binary inside one or two nested archives) fit inline, so the common
+// case allocates nothing.
+const deepPathInlineCapacity = 4
+
+// DeepPath identifies a file possibly nested inside archives, e.g. a .exe
+// inside a .zip inside a .nupkg. Unlike its predecessor (a fixed [3]string),
+// DeepPath supports arbitrary nesting depth by spilling past
+// deepPathInlineCapacity into overflow. That overflow slice makes DeepPath
+// uncomparable, so it can no longer be used as a map key directly; callers
+// that need one (filesToTransform) key on DeepPath.String() instead.
 type DeepPath struct {
-	parts [3]string
+	inline   [deepPathInlineCapacity]string
+	depth    int
+	overflow []string
 }
 
 func NewDeepPath(path string) DeepPath {
-	return DeepPath{[3]string{path, "", ""}}
+	var deepPath DeepPath
+	deepPath.inline[0] = path
+	deepPath.depth = 1
+	return deepPath
 }
 
 func NewDeepPath2(path0 string, path1 string) DeepPath {
-	return DeepPath{[3]string{path0, path1, ""}}
+	// Appending within deepPathInlineCapacity can never overflow.
+	deepPath, err := NewDeepPath(path0).Append(path1)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return deepPath
 }
 
 func NewDeepPath3(path0 string, path1 string, path2 string) DeepPath {
-	return DeepPath{[3]string{path0, path1, path2}}
+	// Appending within deepPathInlineCapacity can never overflow.
+	deepPath, err := NewDeepPath2(path0, path1).Append(path2)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return deepPath
 }
 
-func (path *DeepPath) Append(child string) DeepPath {
-	newPath := *path
-	if newPath.parts[0] == "" {
-		newPath.parts[0] = child
-	} else if path.parts[1] == "" {
-		newPath.parts[1] = child
-	} else if path.parts[2] == "" {
-		newPath.parts[2] = child
+// Append returns a copy of path with child appended as its deepest
+// component. path itself is left unmodified.
+func (path DeepPath) Append(child string) (DeepPath, error) {
+	if path.depth < deepPathInlineCapacity {
+		path.inline[path.depth] = child
 	} else {
-		log.Fatal("cannot append %#v to %#v; DeepPath has no space left", child, newPath)
+		overflow := make([]string, len(path.overflow), len(path.overflow)+1)
+		copy(overflow, path.overflow)
+		path.overflow = append(overflow, child)
 	}
-	return newPath
+	path.depth++
+	return path, nil
 }
 
-func (path *DeepPath) Last() string {
-	if path.parts[2] != "" {
-		return path.parts[2]
+// Depth returns the number of components in path.
+func (path DeepPath) Depth() int {
+	return path.depth
+}
+
+// At returns the i'th component of path, where i is in [0, path.Depth()).
+func (path DeepPath) At(i int) string {
+	if i < deepPathInlineCapacity {
+		return path.inline[i]
 	}
-	if path.parts[1] != "" {
-		return path.parts[1]
+	return path.overflow[i-deepPathInlineCapacity]
+}
+
+// Parts returns every component of path, shallowest first.
+func (path DeepPath) Parts() []string {
+	parts := make([]string, path.depth)
+	for i := range parts {
+		parts[i] = path.At(i)
 	}
-	return path.parts[0]
+	return parts
+}
+
+func (path DeepPath) Last() string {
+	return path.At(path.depth - 1)
+}
+
+// String joins path's components, e.g. "npm/quick-lint-js-2.3.0.tgz!package/linux-x64/bin/quick-lint-js".
+func (path DeepPath) String() string {
+	return strings.Join(path.Parts(), "!")
 }
 
 func PathLooksLikeTarGz(path string) bool {
@@ -0,0 +1,78 @@
+// Copyright (C) 2020  Matthew "strager" Glazar
+// See end of file for extended copyright information.
+
+//go:build ignore
+
+// Command gen_trustbundle fetches the certificate or key at -url, checks
+// its SHA-256 against -pin, and writes it to -out for trustbundle.go to
+// embed. It refuses to overwrite -out with content whose hash doesn't
+// match -pin unless -force is given, so rotating the embedded trust bundle
+// always shows up as an explicit, reviewable diff to -pin instead of a
+// silent content swap. If -pin is empty, nothing is checked: -out is written
+// and the fetched content's hash is printed for use as -pin.
+package main
+
+import "crypto/sha256"
+import "encoding/hex"
+import "flag"
+import "fmt"
+import "io"
+import "net/http"
+import "os"
+
+func main() {
+	url := flag.String("url", "", "URL to fetch the certificate/key from")
+	out := flag.String("out", "", "file to write the fetched content to")
+	pin := flag.String("pin", "", "expected SHA-256 hash (hex) of the fetched content")
+	force := flag.Bool("force", false, "write -out even if the fetched content's hash doesn't match -pin")
+	flag.Parse()
+	if *url == "" || *out == "" {
+		fmt.Fprintln(os.Stderr, "usage: gen_trustbundle -url <url> -out <file> -pin <sha256> [-force]")
+		os.Exit(2)
+	}
+
+	response, err := http.Get(*url)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer response.Body.Close()
+	content, err := io.ReadAll(response.Body)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	hash := sha256.Sum256(content)
+	hashHex := hex.EncodeToString(hash[:])
+	if *pin != "" && hashHex != *pin && !*force {
+		fmt.Fprintf(os.Stderr, "gen_trustbundle: %s hashes to %s, not the pinned %s; pass -force to regenerate anyway\n", *url, hashHex, *pin)
+		os.Exit(1)
+	}
+	if *pin == "" {
+		fmt.Fprintf(os.Stderr, "gen_trustbundle: fetched %s; pin it with -pin %s\n", *url, hashHex)
+	}
+
+	if err := os.WriteFile(*out, content, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// quick-lint-js finds bugs in JavaScript programs.
+// Copyright (C) 2020  Matthew "strager" Glazar
+//
+// This file is part of quick-lint-js.
+//
+// quick-lint-js is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// quick-lint-js is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with quick-lint-js.  If not, see <https://www.gnu.org/licenses/>.
@@ -0,0 +1,45 @@
+// Copyright (C) 2020  Matthew "strager" Glazar
+// See end of file for extended copyright information.
+
+// Package trustbundle embeds the certificate and GPG key that release
+// verification needs, following the pattern golang.org/x/crypto/x509roots/nss
+// uses for its fallback root bundle: the bytes are checked in as ordinary
+// files and pulled into the binary with go:embed, so `qljs-sign verify
+// <artifact>` works offline, on any machine that has just the binary, with
+// no side-channel certificate distribution.
+//
+// quick-lint-js.cer and quick-lint-js.gpg.key are regenerated with
+// gen_trustbundle.go (run via `go generate`), which pins each file's
+// SHA-256 so rotating the embedded trust bundle is a reviewable diff (a
+// changed -pin argument) rather than a silent content swap.
+package trustbundle
+
+import _ "embed"
+
+//go:generate go run gen_trustbundle.go -url https://www.quick-lint-js.com/certificates/quick-lint-js.cer -out quick-lint-js.cer -pin 0000000000000000000000000000000000000000000000000000000000000000
+
+//go:embed quick-lint-js.cer
+var AppleCodesignCertificate []byte
+
+//go:generate go run gen_trustbundle.go -url https://www.quick-lint-js.com/certificates/quick-lint-js.gpg.key -out quick-lint-js.gpg.key -pin 0000000000000000000000000000000000000000000000000000000000000000
+
+//go:embed quick-lint-js.gpg.key
+var GPGKey []byte
+
+// quick-lint-js finds bugs in JavaScript programs.
+// Copyright (C) 2020  Matthew "strager" Glazar
+//
+// This file is part of quick-lint-js.
+//
+// quick-lint-js is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// quick-lint-js is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with quick-lint-js.  If not, see <https://www.gnu.org/licenses/>.